@@ -0,0 +1,51 @@
+package main
+
+import "time"
+
+// longer client message ids are ignored rather than remembered
+const maxClientMsgIDLen = 64
+
+// ackEntry remembers the seq a client message id was acknowledged with
+type ackEntry struct {
+	seq uint64
+	at  time.Time
+}
+
+// ackCache holds a client's recently acknowledged message ids so retried
+// sends are answered with the original ack instead of being broadcast twice.
+// It is owned by the room's run().
+type ackCache struct {
+	entries map[string]ackEntry
+	order   []string
+}
+
+// lookup returns the seq id was acknowledged with within the dedup window
+func (a *ackCache) lookup(id string) (uint64, bool) {
+	entry, ok := a.entries[id]
+	if !ok || time.Since(entry.at) > cfg.ackDedupWindow {
+		return 0, false
+	}
+	return entry.seq, true
+}
+
+// add remembers an acknowledged id, forgetting the oldest beyond the cache size
+func (a *ackCache) add(id string, seq uint64) {
+	if a.entries == nil {
+		a.entries = make(map[string]ackEntry)
+	}
+	if _, ok := a.entries[id]; !ok {
+		a.order = append(a.order, id)
+	}
+	a.entries[id] = ackEntry{seq: seq, at: time.Now()}
+
+	for len(a.order) > cfg.ackCacheSize {
+		delete(a.entries, a.order[0])
+		a.order = a.order[1:]
+	}
+}
+
+// ack confirms to the sender that its message was broadcast as seq
+func (r *room) ack(c *client, id string, seq uint64) {
+	c.acks.add(id, seq)
+	r.send(c, &envelope{Type: "ack", ClientMsgID: id, Seq: seq})
+}
@@ -0,0 +1,71 @@
+package main
+
+import "time"
+
+// activity counts a room's chat messages over the last minute in one second
+// buckets, for the periodic "stats" broadcast
+type activity struct {
+	counts [60]int
+
+	// unix second of the newest bucket
+	last int64
+}
+
+// advance clears the buckets that fell out of the minute before now
+func (a *activity) advance(now int64) {
+	if now <= a.last {
+		return
+	}
+	if now-a.last >= int64(len(a.counts)) {
+		clear(a.counts[:])
+	} else {
+		for s := a.last + 1; s <= now; s++ {
+			a.counts[s%int64(len(a.counts))] = 0
+		}
+	}
+	a.last = now
+}
+
+// add counts a message sent at t
+func (a *activity) add(t time.Time) {
+	a.advance(t.Unix())
+	a.counts[a.last%int64(len(a.counts))]++
+}
+
+// perMinute returns the number of messages sent in the minute before t
+func (a *activity) perMinute(t time.Time) int {
+	a.advance(t.Unix())
+	n := 0
+	for _, c := range a.counts {
+		n += c
+	}
+	return n
+}
+
+// liveStats is what the last "stats" broadcast told the room
+type liveStats struct {
+	users          int
+	messagesPerMin int
+}
+
+// broadcastStats tells the room how many people are in it and how busy it
+// is, every STATS_INTERVAL. Empty rooms and unchanged numbers send nothing.
+func (r *room) broadcastStats() {
+	users := 0
+	for c := range r.clients {
+		if !c.monitor {
+			users++
+		}
+	}
+	if users == 0 {
+		r.lastStats = liveStats{}
+		return
+	}
+
+	stats := liveStats{users: users, messagesPerMin: r.activity.perMinute(time.Now())}
+	if stats == r.lastStats {
+		return
+	}
+	r.lastStats = stats
+	r.broadcast(&envelope{Type: "stats", Users: stats.users, MessagesPerMin: &stats.messagesPerMin})
+}
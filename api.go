@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// roomInfo describes a room in the GET /rooms listing
+type roomInfo struct {
+	Name    string `json:"name"`
+	Clients int    `json:"clients"`
+
+	// number of messages the room keeps and replays to joining clients
+	History int `json:"history"`
+
+	// unix millis at which the room was created and seconds since then
+	Created int64 `json:"created"`
+	Uptime  int64 `json:"uptime"`
+
+	// message of the day shown to joining clients, see /motd
+	MOTD string `json:"motd,omitempty"`
+}
+
+// clientInfo is the body of GET /rooms/{name}/me and an entry of
+// GET /rooms/{name}/users
+type clientInfo struct {
+	Name   string `json:"name"`
+	Color  string `json:"color"`
+	Avatar string `json:"avatar,omitempty"`
+
+	// "moderator", "bot" or "member"
+	Role string `json:"role"`
+
+	// unix millis at which the client joined, and its presence
+	Joined int64  `json:"joined"`
+	Status string `json:"status"`
+
+	// unix millis at which the connection was opened and seconds since then
+	Connected    int64 `json:"connected"`
+	ConnectedFor int64 `json:"connectedFor"`
+
+	// frames and bytes the client sent to the server, and bytes it was sent
+	MessagesSent  int64 `json:"messagesSent"`
+	BytesSent     int64 `json:"bytesSent"`
+	BytesReceived int64 `json:"bytesReceived"`
+}
+
+// info describes the client for the API, called from run()
+func (c *client) info() *clientInfo {
+	return &clientInfo{
+		Name:   c.name,
+		Color:  c.color,
+		Avatar: c.avatar,
+		Role:   c.role(),
+		Joined: c.joined.UnixMilli(),
+		Status: c.status,
+
+		Connected:    c.connected.UnixMilli(),
+		ConnectedFor: int64(time.Since(c.connected) / time.Second),
+
+		MessagesSent:  c.messagesSent.Load(),
+		BytesSent:     c.bytesSent.Load(),
+		BytesReceived: c.bytesReceived.Load(),
+	}
+}
+
+// meHandler serves GET /rooms/{name}/me?session=<token>, the caller's own
+// connection as the room sees it, so a reloaded UI can restore its state
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	rm, ok := lookupRoom(r.PathValue("name"))
+	session := r.URL.Query().Get("session")
+	if !ok || session == "" {
+		http.Error(w, "Not in this room", http.StatusNotFound)
+		return
+	}
+
+	// clients belong to the room's goroutine, so look the session up there
+	var info *clientInfo
+	rm.do(func() {
+		for c := range rm.clients {
+			if c.monitor || subtle.ConstantTimeCompare([]byte(c.session), []byte(session)) != 1 {
+				continue
+			}
+			info = c.info()
+		}
+	})
+	if info == nil {
+		http.Error(w, "Not in this room", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// usersHandler serves GET /rooms/{name}/users, every client in the room
+// with its traffic, oldest connection first, behind ADMIN_TOKEN
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rm, ok := lookupRoom(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if !checkRoomPassword(r.PathValue("name"), r) {
+		http.Error(w, "Invalid room password", http.StatusUnauthorized)
+		return
+	}
+
+	infos := []*clientInfo{}
+	rm.do(func() {
+		for c := range rm.clients {
+			if !c.monitor {
+				infos = append(infos, c.info())
+			}
+		}
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Connected < infos[j].Connected })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// roomsHandler serves GET /rooms, every open room sorted by name
+func roomsHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	all := make([]*room, 0, len(rooms))
+	for _, rm := range rooms {
+		if rm.state == roomActive {
+			all = append(all, rm)
+		}
+	}
+	mu.Unlock()
+
+	infos := make([]roomInfo, 0, len(all))
+	for _, rm := range all {
+		info := roomInfo{
+			Created: rm.created.UnixMilli(),
+			Uptime:  int64(time.Since(rm.created) / time.Second),
+		}
+		// the client list and name belong to the room's goroutine
+		rm.do(func() {
+			info.Name = rm.name
+			info.History = rm.historySize
+			info.MOTD = rm.motd
+			for c := range rm.clients {
+				if !c.monitor {
+					info.Clients++
+				}
+			}
+		})
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// messageHandler serves GET /rooms/{name}/messages/{seq}, a single message
+// from the room's history so it can be linked to directly
+func messageHandler(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseUint(r.PathValue("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message sequence", http.StatusBadRequest)
+		return
+	}
+	if !checkRoomPassword(r.PathValue("name"), r) {
+		http.Error(w, "Invalid room password", http.StatusUnauthorized)
+		return
+	}
+
+	var msg []byte
+	rm, ok := lookupRoom(r.PathValue("name"))
+	if ok {
+		// history belongs to the room's goroutine, so look the message up there
+		rm.do(func() {
+			if e := rm.findMessage(seq); e != nil {
+				msg, err = json.Marshal(e)
+			}
+		})
+	} else {
+		// an archived room's messages are only in the store
+		e, archived, storeErr := archivedMessage(r.PathValue("name"), seq)
+		switch {
+		case !archived:
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		case storeErr != nil:
+			http.Error(w, "Message store unavailable", http.StatusServiceUnavailable)
+			return
+		case e != nil:
+			msg, err = json.Marshal(e)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+	if msg == nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(msg)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"time"
+)
+
+// rooms archived for inactivity, by name, with the configuration they come
+// back with on the next join; guarded by mu
+var archivedRooms = make(map[string]roomConfig)
+
+var (
+	archiveMetric = expvar.NewMap("room_archive")
+	archived      expvar.Int
+	revived       expvar.Int
+)
+
+func init() {
+	archiveMetric.Set("archived", &archived)
+	archiveMetric.Set("revived", &revived)
+	archiveMetric.Set("current", expvar.Func(func() any {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(archivedRooms)
+	}))
+}
+
+// archiving frees rooms only when their history is in a store to come back from
+func archiveEnabled() bool {
+	return cfg.roomArchiveAfter > 0 && store != nil
+}
+
+// checkArchive archives the room once nobody has joined or posted for
+// ROOM_ARCHIVE_AFTER, called from run()
+func (r *room) checkArchive() {
+	if r.archiving || time.Since(r.lastActivity) < cfg.roomArchiveAfter {
+		return
+	}
+	r.archiving = true
+	// closing waits on run(), so it can't happen on this goroutine
+	go archiveRoom(r)
+}
+
+// archiveRoom closes an inactive room, disconnecting anyone still idling in
+// it, and keeps its configuration for when it is revived. Its messages are
+// already in the store, which getRoom reloads them from.
+func archiveRoom(r *room) {
+	var rc roomConfig
+	r.do(func() {
+		rc = r.config()
+	})
+	mu.Lock()
+	archivedRooms[rc.Name] = rc
+	mu.Unlock()
+
+	closeRoom(r, "archived")
+	archived.Add(1)
+	log.Printf("archived room %q after %v without activity", rc.Name, cfg.roomArchiveAfter)
+}
+
+// revive gives a room being created in place of an archived one its
+// configuration back, called by getRoom with mu held before history loads
+func (r *room) revive() {
+	rc, ok := archivedRooms[r.name]
+	if !ok {
+		return
+	}
+	delete(archivedRooms, r.name)
+	r.applyConfig(rc)
+	revived.Add(1)
+}
+
+// archivedMessage looks a message of an archived room up in the store,
+// for permalinks that outlive the room's time in memory
+func archivedMessage(name string, seq uint64) (*envelope, bool, error) {
+	mu.Lock()
+	rc, ok := archivedRooms[name]
+	mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	var history []*envelope
+	err := storeBreaker.call(func() error {
+		var err error
+		history, err = store.Recent(name, rc.HistorySize)
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, errBreakerOpen) {
+			log.Printf("Loading history of archived room %q failed: %v", name, err)
+		}
+		return nil, true, err
+	}
+	for _, e := range history {
+		if e.Seq == seq && !e.Deleted {
+			return e, true, nil
+		}
+	}
+	return nil, true, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// distinct countries, browsers or origins counted before the rest are
+// lumped together as "other", origins are whatever clients send
+const maxAudienceKeys = 200
+
+// geoRange is a block of addresses in one country, from GEOIP_CSV
+type geoRange struct {
+	first, last netip.Addr
+	country     string
+}
+
+// country ranges sorted by first address, loaded once at startup
+var geoRanges []geoRange
+
+// loadGeoIP reads a country database in CSV, one range per row either as
+// first,last,country (the DB-IP Lite layout) or network,country with a
+// CIDR network. Rows that don't parse, like a header, are skipped.
+func loadGeoIP(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	var ranges []geoRange
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if g, ok := parseGeoRange(row); ok {
+			ranges = append(ranges, g)
+		}
+	}
+	if len(ranges) == 0 {
+		return fmt.Errorf("no address ranges in %s", path)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first.Less(ranges[j].first) })
+	geoRanges = ranges
+	return nil
+}
+
+func parseGeoRange(row []string) (geoRange, bool) {
+	switch len(row) {
+	case 2:
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(row[0]))
+		if err != nil {
+			return geoRange{}, false
+		}
+		prefix = prefix.Masked()
+		last := prefix.Addr()
+		for i := prefix.Bits(); i < last.BitLen(); i++ {
+			last = setHostBit(last, i)
+		}
+		return geoRange{first: prefix.Addr(), last: last, country: strings.TrimSpace(row[1])}, true
+	case 3:
+		first, err1 := netip.ParseAddr(strings.TrimSpace(row[0]))
+		last, err2 := netip.ParseAddr(strings.TrimSpace(row[1]))
+		if err1 != nil || err2 != nil || first.Unmap().BitLen() != last.Unmap().BitLen() {
+			return geoRange{}, false
+		}
+		return geoRange{first: first.Unmap(), last: last.Unmap(), country: strings.TrimSpace(row[2])}, true
+	}
+	return geoRange{}, false
+}
+
+// setHostBit sets bit i of addr, counting from the most significant
+func setHostBit(addr netip.Addr, i int) netip.Addr {
+	b := addr.AsSlice()
+	b[i/8] |= 0x80 >> (i % 8)
+	out, _ := netip.AddrFromSlice(b)
+	return out
+}
+
+// countryOf looks an IP up in GEOIP_CSV, "" when unknown
+func countryOf(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || len(geoRanges) == 0 {
+		return ""
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(geoRanges), func(i int) bool { return addr.Less(geoRanges[i].first) })
+	if i == 0 {
+		return ""
+	}
+	g := geoRanges[i-1]
+	if g.last.Less(addr) || g.first.BitLen() != addr.BitLen() {
+		return ""
+	}
+	return g.country
+}
+
+// browserFamily reduces a User-Agent to a coarse browser name, checked in
+// this order as browsers include each other's tokens
+func browserFamily(ua string) string {
+	families := []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+		{"Go-http-client/", "Go"},
+		{"python", "Python"},
+	}
+	if ua == "" {
+		return "unknown"
+	}
+	for _, f := range families {
+		if strings.Contains(ua, f.token) {
+			return f.name
+		}
+	}
+	return "other"
+}
+
+// audience counts accepted connections with CONNECTION_ANALYTICS, never
+// anything that identifies a single client
+var audience = struct {
+	sync.Mutex
+	since     time.Time
+	total     int64
+	countries map[string]int64
+	browsers  map[string]int64
+	origins   map[string]int64
+}{
+	since:     time.Now(),
+	countries: make(map[string]int64),
+	browsers:  make(map[string]int64),
+	origins:   make(map[string]int64),
+}
+
+// countKey adds one to key in counts, or to "other" once counts is full
+func countKey(counts map[string]int64, key string) {
+	if _, ok := counts[key]; !ok && len(counts) >= maxAudienceKeys {
+		key = "other"
+	}
+	counts[key]++
+}
+
+// recordConnection counts, and with CONNECTION_ANALYTICS=log logs, a
+// connection accepted into room. The IP is only used for the country.
+func recordConnection(req *http.Request, room, ip string) {
+	if cfg.connectionAnalytics == "off" {
+		return
+	}
+	country := countryOf(ip)
+	if country == "" {
+		country = "unknown"
+	}
+	browser := browserFamily(req.UserAgent())
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		origin = "none"
+	}
+
+	audience.Lock()
+	audience.total++
+	countKey(audience.countries, country)
+	countKey(audience.browsers, browser)
+	countKey(audience.origins, origin)
+	audience.Unlock()
+
+	if cfg.connectionAnalytics == "log" {
+		connectionLog.printf(room, "connection to room %q: country=%s browser=%s origin=%q user-agent=%q", room, country, browser, origin, req.UserAgent())
+	}
+}
+
+// audienceStats is the body of GET /debug/audience
+type audienceStats struct {
+	// unix millis since which connections were counted
+	Since       int64            `json:"since"`
+	Connections int64            `json:"connections"`
+	Countries   map[string]int64 `json:"countries"`
+	Browsers    map[string]int64 `json:"browsers"`
+	Origins     map[string]int64 `json:"origins"`
+}
+
+// audienceHandler serves GET /debug/audience, accepted connections by
+// country, browser and origin, behind ADMIN_TOKEN
+func audienceHandler(w http.ResponseWriter, req *http.Request) {
+	if cfg.adminToken == "" || cfg.connectionAnalytics == "off" {
+		http.NotFound(w, req)
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	audience.Lock()
+	stats := audienceStats{
+		Since:       audience.since.UnixMilli(),
+		Connections: audience.total,
+		Countries:   maps.Clone(audience.countries),
+		Browsers:    maps.Clone(audience.browsers),
+		Origins:     maps.Clone(audience.origins),
+	}
+	audience.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
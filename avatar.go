@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// avatarURL returns the avatar shown next to a client's messages for the
+// configured AVATAR_SCHEME, or "" when avatars are disabled. With gravatar the
+// client's ?email= is hashed, clients without one get the name's identicon.
+func avatarURL(name, email string) string {
+	switch cfg.avatarScheme {
+	case "gravatar":
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			return "https://www.gravatar.com/avatar/" + sha256Hex(email) + "?d=identicon"
+		}
+		return identiconURL(name)
+	case "identicon":
+		return identiconURL(name)
+	}
+	return ""
+}
+
+// identiconURL is a generated pattern that is the same for everyone seeing name
+func identiconURL(name string) string {
+	return "https://www.gravatar.com/avatar/" + sha256Hex(name) + "?d=identicon&f=y"
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
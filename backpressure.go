@@ -0,0 +1,155 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+// how often disconnecting slow clients is logged at most
+const slowClientLogInterval = 10 * time.Second
+
+// how often each BACKPRESSURE path was taken
+var (
+	backpressureMetric = expvar.NewMap("backpressure")
+	blockedSends       expvar.Int
+	droppedNewest      expvar.Int
+	droppedOldest      expvar.Int
+	slowDisconnects    expvar.Int
+	droppedMonitor     expvar.Int
+)
+
+func init() {
+	backpressureMetric.Set("blocked", &blockedSends)
+	backpressureMetric.Set("dropped_newest", &droppedNewest)
+	backpressureMetric.Set("dropped_oldest", &droppedOldest)
+	backpressureMetric.Set("disconnected", &slowDisconnects)
+	backpressureMetric.Set("dropped_monitor", &droppedMonitor)
+}
+
+// deliver queues msg for a client, applying the BACKPRESSURE policy when
+// its receive channel is full because it isn't reading fast enough. Messages
+// are queued in call order; only updates held back by deliverUpdate can
+// reach a client after messages broadcast later. With FANOUT_MODE=fast the
+// client's fanout worker does this once run() has moved on.
+func (r *room) deliver(c *client, msg []byte) {
+	// a client may have left while an earlier delivery was blocked, its
+	// receive channel is closed then
+	if !r.clients[c] {
+		return
+	}
+	// a monitor never holds a room up whatever BACKPRESSURE says, it
+	// misses frames instead
+	if c.monitor {
+		select {
+		case c.receive <- msg:
+		default:
+			droppedMonitor.Add(1)
+		}
+		return
+	}
+	if c.worker != nil {
+		c.worker.batch = append(c.worker.batch, fanoutOp{c: c, msg: msg})
+		return
+	}
+	if cfg.backpressure == "block" {
+		r.deliverBlocking(c, msg)
+		return
+	}
+	if !queue(c, msg) {
+		r.dropSlow(c)
+	}
+}
+
+// deliverBlocking queues msg with BACKPRESSURE=block, holding the room up
+// until the client catches up or its connection breaks. Leaves are still
+// taken meanwhile: a client stuck behind this one, or this one itself,
+// may go without waiting for it, and is announced after the current event.
+func (r *room) deliverBlocking(c *client, msg []byte) {
+	select {
+	case c.receive <- msg:
+		return
+	default:
+	}
+
+	blockedSends.Add(1)
+	for {
+		select {
+		case c.receive <- msg:
+			return
+		case <-c.done:
+			return
+		case left := <-r.leave:
+			if r.removeLeaving(left) {
+				r.departed = append(r.departed, left)
+			}
+			if left == c {
+				return
+			}
+		}
+	}
+}
+
+// queue sends msg on the client's receive channel by the BACKPRESSURE
+// policy, reporting false when the client should be disconnected as slow.
+// Only one goroutine may send to a client: run(), or its fanout worker.
+func queue(c *client, msg []byte) bool {
+	select {
+	case c.receive <- msg:
+		return true
+	default:
+	}
+
+	switch cfg.backpressure {
+	case "drop_newest":
+		droppedNewest.Add(1)
+	case "drop_oldest":
+		// nobody else sends on receive, so making room always succeeds
+		// unless write() took a message first, in which case try again
+		for {
+			select {
+			case <-c.receive:
+				droppedOldest.Add(1)
+			default:
+			}
+			select {
+			case c.receive <- msg:
+				return true
+			default:
+			}
+		}
+	case "disconnect":
+		return false
+	default:
+		// block until the client catches up, or until write() gave up on a
+		// broken connection and nobody will ever read receive again; only
+		// fanout workers get here, run() uses deliverBlocking
+		blockedSends.Add(1)
+		select {
+		case c.receive <- msg:
+		case <-c.done:
+		}
+	}
+	return true
+}
+
+var slowClientLog struct {
+	sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// logSlowClient logs a slow client being disconnected, at most once per
+// slowClientLogInterval so a struggling server doesn't flood its logs
+func logSlowClient(room, name string) {
+	slowClientLog.Lock()
+	defer slowClientLog.Unlock()
+	if time.Since(slowClientLog.last) < slowClientLogInterval {
+		slowClientLog.suppressed++
+		return
+	}
+	log.Printf("disconnected slow client %s in room %q (%d more since last report)", name, room, slowClientLog.suppressed)
+	slowClientLog.last = time.Now()
+	slowClientLog.suppressed = 0
+}
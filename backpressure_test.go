@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a leave must not wait for a broadcast held up by a client that stopped
+// reading, it is handled meanwhile and announced once the broadcast is done
+func TestLeaveWhileBlockedOnStuckClient(t *testing.T) {
+	withConfig(t, func(c *config) {
+		c.backpressure = "block"
+		c.sendQueueSize = 1
+	})
+	r := newTestRoom(t, "stuck-leave")
+	stuck := joinTestRoom(t, r, "stuck")
+	bob := joinTestRoom(t, r, "bob")
+	carol := joinTestRoom(t, r, "carol")
+
+	stuck.fake.stick()
+	blocked := blockedSends.Value()
+	// bob's read() waits on the room once it blocks, so send from the side
+	go func() {
+		for i := range 3 {
+			select {
+			case bob.fake.in <- []byte(fmt.Sprintf("message %d", i)):
+			case <-bob.fake.closed:
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(testTimeout)
+	for blockedSends.Value() == blocked || len(stuck.receive) < cap(stuck.receive) {
+		if time.Now().After(deadline) {
+			t.Fatal("the room never blocked on the stuck client")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	carol.leave()
+	select {
+	case <-carol.done:
+	case <-time.After(testTimeout):
+		t.Fatal("leave was not handled while the room was blocked")
+	}
+
+	// the leave is announced after the broadcast that was blocked, which
+	// depends on how far the stuck client's queue was filled by the joins
+	stuck.fake.unstick()
+	var messages []string
+	for announced := false; len(messages) < 3 || !announced; {
+		switch e := bob.next(); {
+		case e.Type == "message":
+			messages = append(messages, e.Message)
+		case e.Type == "system" && strings.Contains(e.Message, "carol"):
+			announced = true
+		}
+	}
+	for i, m := range messages {
+		if m != fmt.Sprintf("message %d", i) {
+			t.Fatalf("bob got %q, want message %d", m, i)
+		}
+	}
+	for i := range 3 {
+		if e := stuck.expect("message"); e.Message != fmt.Sprintf("message %d", i) {
+			t.Fatalf("stuck client got %q, want message %d", e.Message, i)
+		}
+	}
+}
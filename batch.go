@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"time"
+)
+
+// how well batching works: messages sent in batches and the frames they took
+var (
+	batchMetric     = expvar.NewMap("batches")
+	batchedMessages expvar.Int
+	batchFrames     expvar.Int
+)
+
+func init() {
+	batchMetric.Set("messages", &batchedMessages)
+	batchMetric.Set("frames", &batchFrames)
+}
+
+// collectBatch waits up to BATCH_WINDOW for more queued messages to send
+// along with first, joined into one JSON array frame when there are several.
+// It reports false when receive was closed meanwhile, called from write().
+func (c *client) collectBatch(first []byte) ([]byte, bool) {
+	batch := [][]byte{first}
+	open := true
+
+	timer := time.NewTimer(cfg.batchWindow)
+	defer timer.Stop()
+collect:
+	for len(batch) < cfg.batchMaxSize {
+		select {
+		case msg, ok := <-c.receive:
+			if !ok {
+				open = false
+				break collect
+			}
+			batch = append(batch, msg)
+		case <-timer.C:
+			break collect
+		}
+	}
+
+	if len(batch) == 1 {
+		return first, open
+	}
+	batchedMessages.Add(int64(len(batch)))
+	batchFrames.Add(1)
+
+	frame := make([]byte, 0, 2+len(batch)*(len(first)+1))
+	frame = append(frame, '[')
+	frame = append(frame, bytes.Join(batch, []byte{','})...)
+	return append(frame, ']'), open
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker stops calling a failing dependency after threshold
+// consecutive failures. Once cooldown has passed a single trial call is let
+// through (half-open): success closes the breaker, failure opens it again.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+
+	// counters published on /debug/vars
+	trips   expvar.Int
+	skipped expvar.Int
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+
+	metrics := expvar.NewMap(name + "_breaker")
+	metrics.Set("trips", &b.trips)
+	metrics.Set("skipped", &b.skipped)
+	metrics.Set("state", expvar.Func(func() any {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.state
+	}))
+	return b
+}
+
+// call runs f unless the breaker is open, in which case errBreakerOpen is returned
+func (b *circuitBreaker) call(f func() error) error {
+	b.mu.Lock()
+	switch b.state {
+	case breakerHalfOpen:
+		// a trial call is already in flight
+		b.mu.Unlock()
+		b.skipped.Add(1)
+		return errBreakerOpen
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.mu.Unlock()
+			b.skipped.Add(1)
+			return errBreakerOpen
+		}
+		b.state = breakerHalfOpen
+	}
+	b.mu.Unlock()
+
+	err := f()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state == breakerHalfOpen {
+			log.Printf("%s circuit breaker closed, %s has recovered", b.name, b.name)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return nil
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerHalfOpen {
+			b.trips.Add(1)
+		}
+		log.Printf("%s circuit breaker open after %d consecutive failures, pausing for %v: %v", b.name, b.failures, b.cooldown, err)
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// capabilities describes what this server is configured to do, so clients
+// can adapt instead of assuming
+type capabilities struct {
+	AuthRequired bool     `json:"authRequired"`
+	Compression  bool     `json:"compression"`
+	Transports   []string `json:"transports"`
+
+	// WebSocket subprotocols, newest first
+	WireVersions []string `json:"wireVersions"`
+
+	MaxMessageBytes int64 `json:"maxMessageBytes"`
+	MaxMessageRunes int   `json:"maxMessageRunes"`
+
+	RateLimits rateLimits `json:"rateLimits"`
+
+	Markdown        bool   `json:"markdown"`
+	EmojiShortcodes bool   `json:"emojiShortcodes"`
+	LinkPreviews    bool   `json:"linkPreviews"`
+	Avatars         string `json:"avatars"`
+	Moderators      bool   `json:"moderators"`
+	NameMode        string `json:"nameMode"`
+	HistorySize     int    `json:"historySize"`
+
+	// seconds, 0 when unlimited
+	EditWindow       float64 `json:"editWindow"`
+	MaxScheduleDelay float64 `json:"maxScheduleDelay"`
+
+	// slash commands, only those the room allows when asked with ?room=
+	Commands []string `json:"commands"`
+
+	// who may send each client frame type: "all", "moderators" or "none",
+	// the room's /types policy when asked with ?room=
+	Types map[string]string `json:"types"`
+}
+
+// rateLimits are per IP, rates in events per second and 0 when disabled
+type rateLimits struct {
+	UpgradeRate      float64 `json:"upgradeRate"`
+	UpgradeBurst     int     `json:"upgradeBurst"`
+	BotMessageRate   float64 `json:"botMessageRate"`
+	BotMessageBurst  int     `json:"botMessageBurst"`
+	RoomCreateLimit  int     `json:"roomCreateLimit"`
+	RoomCreateWindow float64 `json:"roomCreateWindow"`
+}
+
+// capabilitiesHandler serves GET /capabilities, and with ?room=<name> what
+// that open room allows
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	c := capabilities{
+		AuthRequired: false,
+		Compression:  upgrader.EnableCompression,
+		Transports:   []string{"websocket"},
+		WireVersions: subprotocols,
+
+		MaxMessageBytes: cfg.maxMessageBytes,
+		MaxMessageRunes: cfg.maxMessageRunes,
+
+		RateLimits: rateLimits{
+			UpgradeRate:      cfg.upgradeRate,
+			UpgradeBurst:     cfg.upgradeBurst,
+			BotMessageRate:   cfg.botMessageRate,
+			BotMessageBurst:  cfg.botMessageBurst,
+			RoomCreateLimit:  cfg.roomCreateLimit,
+			RoomCreateWindow: cfg.roomCreateWindow.Seconds(),
+		},
+
+		Markdown:        cfg.markdown,
+		EmojiShortcodes: cfg.emojiShortcodes,
+		LinkPreviews:    cfg.unfurlLinks,
+		Avatars:         cfg.avatarScheme,
+		Moderators:      cfg.moderatorKey != "",
+		NameMode:        cfg.nameMode,
+		HistorySize:     cfg.historySize,
+
+		EditWindow:       cfg.editWindow.Seconds(),
+		MaxScheduleDelay: cfg.maxScheduleDelay.Seconds(),
+
+		Commands: commandNames,
+		Types:    typePolicies(nil),
+	}
+	if name := r.URL.Query().Get("room"); name != "" {
+		rm, ok := lookupRoom(name)
+		if !ok {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		rm.do(func() {
+			c.Commands = rm.enabledCommands()
+			c.Types = typePolicies(rm.types)
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
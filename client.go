@@ -2,59 +2,409 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // client represents a single chatting user
 type client struct {
-	// a socket connection for this user
-	socket *websocket.Conn
+	// the connection to this user, a WebSocket unless another Transport is added
+	transport Transport
 
-	// receive is a channel to receive messages from other clients
+	// receive is a channel to receive messages from other clients. Only the
+	// room's run() sends on it, or the client's fanout worker with
+	// FANOUT_MODE=fast, and only write() receives, so a client gets
+	// messages in the order the room handled them.
 	receive chan []byte
 
+	// fanout worker sending on receive, nil when run() does; set at join
+	worker *fanoutWorker
+
+	// closed once write() has returned
+	done chan struct{}
+
 	room *room
 
 	name string
+
+	// display color derived from the name, see nameColor
+	color string
+
+	// secret identifying this connection to endpoints like GET /rooms/{name}/me,
+	// only ever sent to the client itself
+	session string
+
+	// hashed IP and the name the client joined as, the author of its
+	// messages across /nick and reconnects, see clientIdentity; set by run()
+	identity string
+
+	// when the client joined the room, set by run()
+	joined time.Time
+
+	// when the connection was upgraded, set once on creation
+	connected time.Time
+
+	// frames and bytes the client sent, counted by read(), and bytes
+	// written to it, counted by write(); atomics as the API reads them
+	// from other goroutines
+	messagesSent  atomic.Int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+
+	// close frame sent once receive is closed, set by close; zero for a
+	// normal close
+	closeCode   int
+	closeReason string
+	closeOnce   sync.Once
+
+	// avatar image URL assigned on connect, empty when avatars are disabled
+	avatar string
+
+	// moderators may manage other users' messages
+	moderator bool
+
+	// negotiated subprotocol such as "chat.v2", empty if the client asked for none
+	protocol string
+
+	// wire format version the client receives, see encode
+	version int
+
+	// receives v2 envelopes as protobuf binary frames, negotiated with the
+	// chat.v2.proto subprotocol
+	binary bool
+
+	// receives messages queued within BATCH_WINDOW as one JSON array frame,
+	// asked for with ?batch=1 by v2 clients
+	batch bool
+
+	// hidden pseudo-client relaying the room to a monitor, see monitorHandler
+	monitor bool
+
+	// automated participant connected with ?bot=1, never marked away and
+	// subject to botLimiter
+	bot bool
+
+	// hashed client IP, see ipKey
+	ip string
+
+	// Origin header of the upgrade, checked again by /forward against
+	// ROOM_ORIGINS of the target room
+	origin string
+
+	// language of the system messages sent to this client
+	lang string
+
+	// timezone for pre-formatted timestamps, nil when the client wants raw millis only
+	loc *time.Location
+
+	// recently acknowledged clientMsgIds, only touched by the room's run()
+	acks ackCache
+
+	// presence, only touched by the room's run()
+	status     string
+	lastActive time.Time
+
+	// left before its queued join was handled, only touched by the room's run()
+	left bool
+
+	// why the client's connection ended, see leaveReason; set by read()
+	// before the client's leave is sent to the room
+	leaveReason string
+
+	// last /nick, only touched by the room's run()
+	renamed time.Time
+
+	// name the client asked for when it joined as a suffixed one like
+	// alice2 because alice was taken, see reclaimName
+	wanted string
+
+	// coalesced updates waiting for room in receive by key, oldest key
+	// first, only touched by the room's run()
+	pending      map[string][]byte
+	pendingOrder []string
+}
+
+// role describes the client's privileges for display
+func (c *client) role() string {
+	switch {
+	case c.moderator:
+		return "moderator"
+	case c.bot:
+		return "bot"
+	}
+	return "member"
+}
+
+// wire format versions, v1 is the legacy {"name","message"} shape
+const (
+	wireV1 = 1
+	wireV2 = 2
+)
+
+// wireVersion picks the wire format from the negotiated subprotocol, then
+// ?v=, defaulting to v2 which the bundled frontend speaks
+func wireVersion(protocol, param string) int {
+	switch {
+	case protocol == "chat.v1":
+		return wireV1
+	case protocol == "chat.v2", protocol == protoSubprotocol:
+		return wireV2
+	case param == "1":
+		return wireV1
+	}
+	return wireV2
+}
+
+// variant identifies how messages are rendered for this client, clients
+// with the same variant can share encoded messages
+func (c *client) variant() string {
+	v := strconv.Itoa(c.version)
+	if c.binary {
+		v += "/proto"
+	}
+	if c.loc == nil {
+		return v
+	}
+	return v + "/" + c.loc.String()
+}
+
+// encode renders e in the client's wire format, adding a timestamp formatted
+// in its timezone when it asked for one. It returns nil for messages the
+// format has no way to express, those are not sent. This is the one place
+// envelopes become frames: JSON and protobuf v2 carry the same fields.
+func (c *client) encode(e *envelope) ([]byte, error) {
+	if c.version == wireV1 {
+		return encodeV1(e)
+	}
+	out := *e
+	out.V = wireV2
+	if c.loc != nil && e.Time != 0 {
+		out.TimeText = time.UnixMilli(e.Time).In(c.loc).Format(time.RFC3339)
+	}
+	if c.binary {
+		return encodeProto(&out), nil
+	}
+	return json.Marshal(&out)
+}
+
+// encodeV1 flattens chat and system messages to the legacy shape and drops
+// everything else, legacy clients show every frame as a chat line
+func encodeV1(e *envelope) ([]byte, error) {
+	switch {
+	case e.Type == "message" && !e.Deleted:
+		return json.Marshal(legacyMessage{Name: e.Name, Message: e.Message})
+	case e.Type == "system" || e.Type == "error" || e.Type == "closing":
+		return json.Marshal(legacyMessage{Name: "system", Message: e.Message})
+	}
+	return nil, nil
+}
+
+// parseTimezone loads the IANA timezone from ?tz=, falling back to UTC for
+// unknown names and returning nil when none was requested
+func parseTimezone(name string) *time.Location {
+	if name == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// notify asks the room to send this client a system message, so that only
+// the room's goroutine ever writes to receive
+func (c *client) notify(key string, args ...any) {
+	c.room.submit(&envelope{Type: "notify", from: c, key: key, args: args})
+}
+
+// recoverPanic logs a panic in one of the client's goroutines, the deferred
+// cleanup then disconnects just this client
+func (c *client) recoverPanic(loop string) {
+	if err := recover(); err != nil {
+		log.Printf("panic in %s loop of %s in room %q: %v\n%s", loop, c.name, c.room.name, err, debug.Stack())
+	}
 }
 
 // send message function
 func (c *client) read() {
 
-	defer c.socket.Close()
+	defer c.transport.Close()
+	defer c.recoverPanic("read")
+
+	// a client that stops answering pings is considered gone
+	c.transport.SetReadDeadline(time.Now().Add(cfg.pongWait))
+	c.transport.OnPong(func() {
+		c.transport.SetReadDeadline(time.Now().Add(cfg.pongWait))
+	})
 
 	// infinite loop , keep reading
 	for {
-		_, msg, err := c.socket.ReadMessage()
+		msg, err := c.transport.Read()
 		if err != nil {
+			c.leaveReason = leaveReason(err)
 			return
 		}
+		c.messagesSent.Add(1)
+		c.bytesSent.Add(int64(len(msg)))
 
-		// incoming message from the client into json
-		outgoing := map[string]string{
-			"name":    c.name,
-			"message": string(msg),
+		// structured frames like votes arrive as JSON objects, anything else is chat text
+		e := parseFrame(msg)
+		if e == nil {
+			e = newMessage("", string(msg))
 		}
+		e.Bot = c.bot
+		e.from = c
+		e.received = true
 
-		jsMessage, err := json.Marshal(outgoing)
-		if err != nil {
-			fmt.Println("Enconding failed!")
+		text, truncated, rejected := prepareText(e.Message)
+		if rejected != nil {
+			c.reject(rejected.code, rejected.key, rejected.args...)
 			continue
 		}
+		e.Message = text
+
+		// blank messages would only show up as empty lines, drop them quietly;
+		// whitespace inside real messages is left alone
+		if e.Type == "message" && strings.TrimSpace(e.Message) == "" {
+			continue
+		}
+		if truncated {
+			c.notify("message_truncated", cfg.maxMessageRunes)
+		}
+
+		// bots share a budget per IP so reconnecting doesn't reset it
+		if c.bot && botLimiter != nil && e.Type == "message" {
+			if ok, _ := botLimiter.allow(c.ip); !ok {
+				c.reject(errRateLimited, "bot_rate_limited")
+				continue
+			}
+		}
 
 		// forward message to the room
-		c.room.forward <- jsMessage
+		c.room.submit(e)
 	}
 }
 
-func (c *client) write() {
-	defer c.socket.Close()
-	for msg := range c.receive {
-		err := c.socket.WriteMessage(websocket.TextMessage, msg)
-		if err != nil {
+// why a client left on its own, as announced to the room and passed to hooks
+const (
+	leftNormally  = "left"
+	leftGoingAway = "going_away"
+	leftLost      = "connection_lost"
+	leftWithError = "error"
+)
+
+// leaveMessages are the i18n keys announcing each way of leaving
+var leaveMessages = map[string]string{
+	leftNormally:  "left",
+	leftGoingAway: "left_going_away",
+	leftLost:      "left_connection_lost",
+	leftWithError: "left_error",
+}
+
+// clientIdentity is who the server takes a client to be when it decides
+// who may edit or delete a message, the hashed IP alone would let everyone
+// behind one NAT edit each other's messages
+func clientIdentity(ip, name string) string {
+	return ip + "/" + name
+}
+
+// leaveReason tells from the error that ended read() why the client left:
+// a close frame with 1000 or without a code is a normal leave, 1001 a
+// closed tab or page navigation and any other code a problem the client
+// reported. No close frame at all, a timeout or a failed read means the
+// connection was lost.
+func leaveReason(err error) string {
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return leftLost
+	}
+	switch closeErr.Code {
+	case websocket.CloseNormalClosure, websocket.CloseNoStatusReceived:
+		return leftNormally
+	case websocket.CloseGoingAway:
+		return leftGoingAway
+	case websocket.CloseAbnormalClosure:
+		return leftLost
+	}
+	return leftWithError
+}
+
+// close ends the client's connection with the given close frame, whatever
+// path removes it from its room: write() sends everything already queued,
+// then the close frame, and closes the socket. Only the first call counts,
+// later ones are no-ops, and nothing may be sent on receive afterwards.
+// Called from the room's run(), a fanout worker closes receive behind what
+// it still has queued.
+func (c *client) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeReason = code, reason
+		if c.worker != nil {
+			c.worker.batch = append(c.worker.batch, fanoutOp{c: c, close: true})
 			return
 		}
+		close(c.receive)
+	})
+}
+
+// writeClose sends the close frame set by close, once receive is closed
+// because the client has left or was disconnected and everything queued has
+// been written
+func (c *client) writeClose() {
+	code := c.closeCode
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+	c.transport.SetWriteDeadline(time.Now().Add(cfg.writeWait))
+	c.transport.WriteClose(code, c.closeReason)
+}
+
+// write sends queued messages and pings until receive is closed or a write
+// fails. Failed writes are not retried: gorilla/websocket keeps the first
+// write error, timeouts included, and returns it from every later write,
+// and a timed out write may have left half a frame on the wire. Giving up
+// at once lets the room drop the client so it can reconnect.
+func (c *client) write() {
+	clientWrites.Add(1)
+	defer clientWrites.Add(-1)
+	ticker := time.NewTicker(cfg.pingInterval)
+	defer ticker.Stop()
+	defer close(c.done)
+	defer c.transport.Close()
+	defer c.recoverPanic("write")
+	for {
+		select {
+		case msg, ok := <-c.receive:
+			if !ok {
+				c.writeClose()
+				return
+			}
+			open := true
+			if c.batch {
+				msg, open = c.collectBatch(msg)
+			}
+			c.transport.SetWriteDeadline(time.Now().Add(cfg.writeWait))
+			if err := c.transport.Write(msg); err != nil {
+				return
+			}
+			c.bytesReceived.Add(int64(len(msg)))
+			if !open {
+				c.writeClose()
+				return
+			}
+		case <-ticker.C:
+			c.transport.SetWriteDeadline(time.Now().Add(cfg.writeWait))
+			if err := c.transport.Ping(); err != nil {
+				return
+			}
+		}
 	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+// updates replaced by a newer one before the client could receive them
+var coalescedUpdates = expvar.NewInt("coalesced_updates")
+
+// coalesceKey names the state an update message replaces, so only the
+// latest one per key needs to reach a client that is falling behind.
+// Chat messages and everything else return "" and are never coalesced.
+func coalesceKey(e *envelope) string {
+	switch e.Type {
+	case "presence":
+		return "presence " + e.Name
+	case "receipts", "stats":
+		return e.Type
+	}
+	return ""
+}
+
+// deliverUpdate queues an update for a client with COALESCE_UPDATES, holding
+// it back in place of any older update with the same key while the client's
+// receive channel is full instead of applying BACKPRESSURE
+func (r *room) deliverUpdate(c *client, key string, msg []byte) {
+	if len(c.pending) == 0 {
+		select {
+		case c.receive <- msg:
+			return
+		default:
+		}
+	}
+
+	if c.pending == nil {
+		c.pending = make(map[string][]byte)
+	}
+	if _, ok := c.pending[key]; ok {
+		coalescedUpdates.Add(1)
+	} else {
+		c.pendingOrder = append(c.pendingOrder, key)
+	}
+	c.pending[key] = msg
+
+	if r.updatesPending {
+		return
+	}
+	r.updatesPending = true
+	time.AfterFunc(cfg.coalesceInterval, func() {
+		r.submit(&envelope{Type: "flushupdates"})
+	})
+}
+
+// flushUpdates hands held back updates to clients that have caught up,
+// oldest key first, and tries again later for those that haven't
+func (r *room) flushUpdates() {
+	r.updatesPending = false
+
+	waiting := false
+	for c := range r.clients {
+		for len(c.pendingOrder) > 0 {
+			key := c.pendingOrder[0]
+			select {
+			case c.receive <- c.pending[key]:
+				delete(c.pending, key)
+				c.pendingOrder = c.pendingOrder[1:]
+				continue
+			default:
+			}
+			waiting = true
+			break
+		}
+	}
+
+	if waiting {
+		r.updatesPending = true
+		time.AfterFunc(cfg.coalesceInterval, func() {
+			r.submit(&envelope{Type: "flushupdates"})
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// upper bound for /history, each room keeps its history in memory
+const maxRoomHistory = 1000
+
+// shouting is meant for short announcements, not walls of text
+const maxShoutLen = 200
+
+// the message of the day may hold a few paragraphs of rules, not a manual
+const maxMOTDLen = 2000
+
+// command runs a slash command sent as a chat message, called from run()
+func (r *room) command(e *envelope) {
+	args := splitArgs(e.Message)
+	if len(args) == 0 {
+		return
+	}
+	if !r.commandEnabled(args[0]) {
+		r.reject(e.from, errCommandDisabled, "command_disabled", args[0])
+		return
+	}
+
+	switch args[0] {
+	case "/poll":
+		r.createPoll(e.from, args[1:])
+	case "/closepoll":
+		r.closePollCommand(e.from, args[1:])
+	case "/forward":
+		r.forwardCommand(e.from, args[1:])
+	case "/delete":
+		r.deleteCommand(e.from, args[1:])
+	case "/history":
+		r.historyCommand(e.from, args[1:])
+	case "/shout", "/code":
+		r.formatCommand(e, args[0][1:])
+	case "/nick":
+		r.nickCommand(e.from, args[1:])
+	case "/motd":
+		r.motdCommand(e)
+	case "/setpass":
+		r.setPasswordCommand(e.from, args[1:])
+	case "/pause":
+		r.setPaused(e.from, true)
+	case "/resume":
+		r.setPaused(e.from, false)
+	case "/commands":
+		r.commandsCommand(e.from, args[1:])
+	case "/types":
+		r.typesCommand(e.from, args[1:])
+	default:
+		r.reject(e.from, errInvalidCommand, "unknown_command", args[0])
+	}
+}
+
+// forwardCommand handles /forward <seq> <targetRoom>, reposting a message
+// from this room's history into another room
+func (r *room) forwardCommand(c *client, args []string) {
+	if len(args) != 2 {
+		r.reject(c, errInvalidCommand, "forward_usage")
+		return
+	}
+	seq, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		r.reject(c, errInvalidCommand, "forward_usage")
+		return
+	}
+	original := r.findMessage(seq)
+	if original == nil {
+		r.reject(c, errNotFound, "message_not_found", seq)
+		return
+	}
+
+	// the target's access controls apply as if the client joined it
+	targetName := args[1]
+	if !validRoomName(targetName) {
+		r.reject(c, errInvalidCommand, "forward_bad_room", targetName)
+		return
+	}
+	if allowed, listed := roomOriginAllowed(targetName, c.origin); listed && !allowed {
+		r.reject(c, errForbidden, "forward_origin", targetName)
+		return
+	}
+	target, ok := lookupRoom(targetName)
+	if !ok {
+		if !cfg.forwardCreateRooms {
+			r.reject(c, errNotFound, "room_not_found", targetName)
+			return
+		}
+		if ok, wait := roomCreationAllowed(c.ip, targetName); !ok {
+			r.reject(c, errRateLimited, "forward_limited", wait.Round(time.Second))
+			return
+		}
+		target = getRoom(targetName)
+	}
+
+	forwarded := newMessage(original.Name, original.Message)
+	forwarded.Forwarded = true
+	forwarded.Room = r.name
+
+	// never block this room's loop on another room's, they may be forwarding
+	// to each other; the outcome comes back through this room's queue
+	go func() {
+		var hash []byte
+		var paused bool
+		target.do(func() {
+			hash, paused = target.passwordHash, target.paused
+		})
+		// the client never gave the target's password, moderators need none
+		// and may post in paused rooms
+		switch {
+		case hash != nil && !c.moderator:
+			c.reject(errForbidden, "forward_protected", targetName)
+			return
+		case paused && !c.moderator:
+			c.reject(errRoomPaused, "forward_paused", targetName)
+			return
+		}
+		target.submit(forwarded)
+		c.notify("forwarded", seq, targetName)
+	}()
+}
+
+// deleteCommand handles /delete <seq>, only the author or a moderator may
+// delete a message
+func (r *room) deleteCommand(c *client, args []string) {
+	if len(args) != 1 {
+		r.reject(c, errInvalidCommand, "delete_usage")
+		return
+	}
+	seq, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		r.reject(c, errInvalidCommand, "delete_usage")
+		return
+	}
+	e := r.findMessage(seq)
+	if e == nil {
+		r.reject(c, errNotFound, "message_not_found", seq)
+		return
+	}
+	if (e.author == "" || e.author != c.identity) && !c.moderator {
+		r.reject(c, errForbidden, "delete_not_author")
+		return
+	}
+
+	// keep the entry as a tombstone so the seq stays taken and replays skip it
+	e.Deleted = true
+	e.Message = ""
+	e.HTML = ""
+	update := &envelope{Type: "delete", Seq: seq}
+	r.broadcast(update)
+	saveMessage(r.name, update)
+}
+
+// formatCommand handles /shout <text> and /code <text>, posting text as is
+// with a format hint for the frontend
+func (r *room) formatCommand(e *envelope, format string) {
+	text := commandText(e.Message, "/"+format)
+	switch {
+	case strings.TrimSpace(text) == "":
+		r.reject(e.from, errInvalidCommand, "format_usage", format)
+		return
+	case format == "shout" && utf8.RuneCountInString(text) > maxShoutLen:
+		r.reject(e.from, errMessageTooLong, "shout_too_long", maxShoutLen)
+		return
+	}
+	e.Message = text
+	e.Format = format
+	r.post(e)
+}
+
+// setPaused handles /pause and /resume, switching the room in and out of
+// read-only maintenance mode
+func (r *room) setPaused(c *client, paused bool) {
+	if !c.moderator {
+		r.reject(c, errForbidden, "moderators_only")
+		return
+	}
+	if r.paused == paused {
+		return
+	}
+	r.paused = paused
+	r.saveRoomConfig()
+	if paused {
+		r.announce("paused", c.name)
+	} else {
+		r.announce("resumed", c.name)
+	}
+}
+
+// historyCommand handles /history <n>, changing how many messages this room
+// keeps and replays to joining clients
+func (r *room) historyCommand(c *client, args []string) {
+	if !c.moderator {
+		r.reject(c, errForbidden, "moderators_only")
+		return
+	}
+	if len(args) != 1 {
+		r.reject(c, errInvalidCommand, "history_usage", maxRoomHistory)
+		return
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 || n > maxRoomHistory {
+		r.reject(c, errInvalidCommand, "history_usage", maxRoomHistory)
+		return
+	}
+	r.historySize = n
+	r.trimHistory(n)
+	r.saveRoomConfig()
+	r.notify(c, "history_set", n)
+}
+
+// commandText returns the raw text after a command, dropping only the
+// separator after it so indentation and line breaks are kept
+func commandText(message, command string) string {
+	text := strings.TrimPrefix(message, command)
+	if len(text) > 0 && (text[0] == ' ' || text[0] == '\n' || text[0] == '\t') {
+		text = text[1:]
+	}
+	return text
+}
+
+// motdCommand handles /motd <text>, setting the message of the day every
+// joining client is shown; /motd alone clears it
+func (r *room) motdCommand(e *envelope) {
+	c := e.from
+	if !c.moderator {
+		r.reject(c, errForbidden, "moderators_only")
+		return
+	}
+	text := commandText(e.Message, "/motd")
+	if strings.TrimSpace(text) == "" {
+		text = ""
+	}
+	if utf8.RuneCountInString(text) > maxMOTDLen {
+		r.reject(c, errMessageTooLong, "motd_too_long", maxMOTDLen)
+		return
+	}
+	r.motd = text
+	r.saveRoomConfig()
+	if text == "" {
+		r.notify(c, "motd_cleared")
+	} else {
+		r.notify(c, "motd_set")
+	}
+}
+
+// splitArgs splits a command line on whitespace, keeping "double quoted"
+// arguments together so they may contain spaces
+func splitArgs(line string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, started := false, false
+
+	for _, ch := range line {
+		switch {
+		case ch == '"':
+			inQuotes = !inQuotes
+			started = true
+		case !inQuotes && (ch == ' ' || ch == '\t' || ch == '\n'):
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(ch)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, current.String())
+	}
+	return args
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// commandNames are the slash commands command dispatches, in the order
+// they are listed
+var commandNames = []string{
+	"/poll", "/closepoll", "/forward", "/delete", "/history", "/shout", "/code",
+	"/nick", "/motd", "/setpass", "/pause", "/resume", "/commands", "/types",
+}
+
+// commandEnabled reports whether the room allows a command. Unknown
+// commands pass so they are reported as unknown, and /commands is always
+// allowed so moderators can't lock themselves out.
+func (r *room) commandEnabled(name string) bool {
+	return r.commands == nil || name == "/commands" || !slices.Contains(commandNames, name) || r.commands[name]
+}
+
+// enabledCommands lists the commands the room allows, called from run()
+func (r *room) enabledCommands() []string {
+	enabled := []string{}
+	for _, name := range commandNames {
+		if r.commandEnabled(name) {
+			enabled = append(enabled, name)
+		}
+	}
+	return enabled
+}
+
+// setCommands restricts the room to the given commands, nil allows all
+func (r *room) setCommands(names []string) {
+	if names == nil {
+		r.commands = nil
+		return
+	}
+	r.commands = make(map[string]bool, len(names))
+	for _, name := range names {
+		r.commands[name] = true
+	}
+}
+
+// commandsCommand handles /commands, listing what the room allows, and
+// for moderators /commands all, /commands none or /commands <command>...
+// to change it
+func (r *room) commandsCommand(c *client, args []string) {
+	if len(args) == 0 {
+		r.notify(c, "commands_enabled", strings.Join(r.enabledCommands(), " "))
+		return
+	}
+	if !c.moderator {
+		r.reject(c, errForbidden, "moderators_only")
+		return
+	}
+
+	var names []string
+	switch {
+	case len(args) == 1 && args[0] == "all":
+	case len(args) == 1 && args[0] == "none":
+		names = []string{}
+	default:
+		for _, arg := range args {
+			name := "/" + strings.TrimPrefix(arg, "/")
+			if !slices.Contains(commandNames, name) {
+				r.reject(c, errInvalidCommand, "unknown_command", name)
+				return
+			}
+			names = append(names, name)
+		}
+	}
+	r.setCommands(names)
+	r.saveRoomConfig()
+	r.notify(c, "commands_enabled", strings.Join(r.enabledCommands(), " "))
+}
+
+// commandList is how the room's allowlist is saved, nil when all commands
+// are allowed; called from run()
+func (r *room) commandList() []string {
+	if r.commands == nil {
+		return nil
+	}
+	names := []string{}
+	for _, name := range commandNames {
+		if r.commands[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the server settings read from the environment at startup
+type config struct {
+	// rooms without joins or chat messages for this long are archived when
+	// there is a message store, 0 keeps them in memory
+	roomArchiveAfter time.Duration
+
+	// HTTP server timeouts against slow clients: reading request headers,
+	// keeping idle keep-alive connections, and reading and writing a whole
+	// request on routes other than WebSocket upgrades; 0 for none
+	httpReadHeaderTimeout time.Duration
+	httpIdleTimeout       time.Duration
+	httpReadTimeout       time.Duration
+	httpWriteTimeout      time.Duration
+
+	// URL prefix every route is served under, like "/chat-app", empty for none
+	basePath string
+
+	// re-parse templates on every request instead of once, for development
+	templateReload bool
+
+	// files with one word per line for generated names, empty uses the built-in lists
+	nameAdjectivesFile string
+	nameNounsFile      string
+
+	// directory of <lang>.json system message catalogs merged over the built-in ones
+	localeDir string
+
+	// avatars assigned to clients: "gravatar", "identicon" or "none"
+	avatarScheme string
+
+	// clients with no activity for this long are shown as away, 0 disables it
+	awayAfter time.Duration
+
+	// rooms broadcast their user count and message rate this often, 0 disables it
+	statsInterval time.Duration
+
+	// token for operator endpoints like /monitor, empty disables them
+	adminToken string
+
+	// clients connecting with ?mod=<key> become moderators, empty disables moderators
+	moderatorKey string
+
+	// connection health: the server pings every pingInterval, a client that
+	// hasn't answered within pongWait is disconnected, and a single write may
+	// take at most writeWait
+	pingInterval time.Duration
+	pongWait     time.Duration
+	writeWait    time.Duration
+
+	// idle time before the OS starts TCP keepalive probes on a WebSocket
+	// connection, also the time between probes; 0 disables them
+	tcpKeepAlive time.Duration
+
+	// CORS response headers, see CORSMiddleware. Preflights offer the methods
+	// routed for the path, only those in corsAllowedMethods when it is set,
+	// and a zero max age leaves preflight caching to the browser's default.
+	corsAllowedMethods []string
+	corsAllowedHeaders string
+	corsMaxAge         time.Duration
+
+	// per-connection socket buffers in bytes, each connection holds both for
+	// its whole lifetime
+	readBufferSize  int
+	writeBufferSize int
+
+	// share write buffers between connections instead of one per connection
+	writeBufferPool bool
+
+	// cap on simultaneous WebSocket connections across all rooms, 0 for no limit
+	maxConnections int
+
+	// upgrade attempts allowed per IP per second (0 disables the limit) and
+	// the networks exempt from it
+	upgradeRate      float64
+	upgradeBurst     int
+	upgradeRateAllow []*net.IPNet
+
+	// rooms each IP may create per window, 0 disables the limit
+	roomCreateLimit  int
+	roomCreateWindow time.Duration
+
+	// messages per second allowed from bots on the same IP, 0 disables the limit
+	botMessageRate  float64
+	botMessageBurst int
+
+	// proxies whose X-Forwarded-For and X-Real-IP headers are trusted, see clientIP
+	trustedProxies []*net.IPNet
+
+	// secret for hashing client IPs, see ipKey
+	ipHashSecret []byte
+
+	// what to do when a client's queue is full: "block" the room until it
+	// catches up, "drop_oldest" or "drop_newest" message, or "disconnect" it
+	backpressure string
+
+	// "strict" delivers every message from the room's goroutine, "fast"
+	// hands delivery to fanoutWorkers goroutines per room, see fanout.go
+	fanoutMode    string
+	fanoutWorkers int
+
+	// log room creation, joins and leaves
+	auditLog bool
+
+	// "stats" counts accepted connections by country, browser and origin,
+	// "log" also logs each one, "off" does neither; countries come from
+	// the GEOIP_CSV database at geoIPFile
+	connectionAnalytics string
+	geoIPFile           string
+
+	// joins, leaves and upgrade problems are logged in full logSampleBurst
+	// times per room and logSummaryInterval, then one in logSampleRate (0
+	// for none), see sampledLog; a zero interval logs everything
+	logSampleBurst     int
+	logSampleRate      int
+	logSummaryInterval time.Duration
+
+	// number of chat messages each room keeps and replays to joining clients,
+	// and the most bytes of them replayed to one client (0 for no limit)
+	historySize        int
+	historyReplayBytes int
+
+	// how many clientMsgIds are remembered per client, and for how long, to
+	// answer retried sends with the original ack
+	ackCacheSize   int
+	ackDedupWindow time.Duration
+
+	// how long after sending a message its author may still edit it, 0 for no limit
+	editWindow time.Duration
+
+	// keep history as JSON lines in per-room files under historyDir, rotating
+	// a file once it reaches historyMaxBytes (0 never rotates)
+	historyDir      string
+	historyMaxBytes int64
+
+	// AES-GCM keys history is encrypted with and may have been encrypted
+	// with, for historyEncryptRooms or every room when it is empty
+	historyKey          string
+	historyOldKeys      []string
+	historyEncryptRooms []string
+
+	// queued messages are written to the store in batches by a background
+	// writer; a full queue either blocks the room or drops the save
+	storeQueueSize     int
+	storeQueuePolicy   string
+	storeBatchSize     int
+	storeFlushInterval time.Duration
+
+	// after this many consecutive store failures saves are skipped for the cooldown
+	storeBreakerThreshold int
+	storeBreakerCooldown  time.Duration
+
+	// minimum time between two /nick renames of the same client, 0 for no limit
+	nickCooldown time.Duration
+
+	// hand a freed name to the client suffixed for wanting it, see reclaimName
+	nameReclaim bool
+
+	// what to do when a client offers only subprotocols we don't speak:
+	// "reject" the upgrade or "fallback" to connecting without one
+	subprotocolPolicy string
+
+	// capacity of each room's join and leave channels, so bursts of
+	// connections don't wait on the room's loop; 0 for unbuffered
+	joinQueueSize int
+
+	// clients asking for ?batch=1 get the messages queued for them within
+	// batchWindow, at most batchMaxSize, as one frame; 0 disables batching
+	batchWindow  time.Duration
+	batchMaxSize int
+
+	// "drain" shuts down in steps so clients can move to other instances,
+	// "hard" closes every connection at once
+	shutdownMode string
+
+	// draining: how long /readyz reports 503 before requests stop being
+	// accepted, how long in-flight requests get to finish, and how long
+	// clients get to reconnect elsewhere after the restart notice
+	shutdownReadyDelay    time.Duration
+	shutdownHTTPTimeout   time.Duration
+	shutdownReconnectWait time.Duration
+
+	// minimum time between two /setpass changes of a room's password
+	passwordCooldown time.Duration
+
+	// reconnect hint sent to clients disconnected by a restart, see reconnectHint
+	reconnectAfter    time.Duration
+	reconnectLoadStep int
+	reconnectJitter   bool
+
+	// how clients get their names: "anonymous" always generates one, "mixed"
+	// takes a valid ?name= and generates the rest, "named" requires ?name=
+	nameMode string
+
+	// rooms that only accept WebSocket upgrades from certain origins
+	roomOrigins []roomOrigins
+
+	// rooms that accept webhooks, with the token each needs
+	hookTokens []hookToken
+
+	// capacity of each client's receive queue, overridden per client type
+	// or subprotocol by sendQueueSizes, see sendQueueSize
+	sendQueueSize  int
+	sendQueueSizes map[string]int
+
+	// on shutdown clients get this long to receive their queued messages
+	// before their connections are closed
+	shutdownGrace time.Duration
+
+	// hold back presence and receipt updates for clients that fall behind,
+	// keeping only the latest of each, and retry every coalesceInterval
+	coalesceUpdates  bool
+	coalesceInterval time.Duration
+
+	// read receipt updates are coalesced and broadcast at most this often
+	receiptInterval time.Duration
+
+	// let /forward create the target room when it doesn't exist yet
+	forwardCreateRooms bool
+
+	// fetch OpenGraph previews for links posted in chat (adds outbound requests)
+	unfurlLinks   bool
+	unfurlTimeout time.Duration
+
+	// frames larger than maxMessageBytes close the connection; messages longer
+	// than maxMessageRunes characters are rejected or truncated
+	maxMessageBytes    int64
+	maxMessageRunes    int
+	messageRunesPolicy string
+
+	// trailing whitespace is trimmed and runs of more than maxBlankLines
+	// blank lines are collapsed (or the message rejected), -1 disables this
+	maxBlankLines    int
+	whitespacePolicy string
+
+	// render a Markdown subset of chat messages to HTML, see renderMarkdown
+	markdown bool
+
+	// expand :shortcode: emoji in messages before broadcasting
+	emojiShortcodes bool
+
+	// close polls automatically after this long, 0 keeps them open until /closepoll
+	pollTimeout time.Duration
+
+	// limits for {"type":"schedule"} messages, and whether they are still
+	// sent once their author has disconnected
+	maxScheduledPerUser int
+	maxScheduledPerRoom int
+	maxScheduleDelay    time.Duration
+	scheduleAfterLeave  bool
+}
+
+// cfg is loaded in main() once the .env file has been applied
+var cfg config
+
+func loadConfig() config {
+	c := config{
+		basePath: envBasePath("BASE_PATH"),
+
+		httpReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		httpIdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+		httpReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		httpWriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+
+		roomArchiveAfter: envDuration("ROOM_ARCHIVE_AFTER", 0),
+
+		templateReload: envBool("TEMPLATE_RELOAD", false),
+
+		nameAdjectivesFile: os.Getenv("NAME_ADJECTIVES_FILE"),
+		nameNounsFile:      os.Getenv("NAME_NOUNS_FILE"),
+
+		localeDir: os.Getenv("LOCALE_DIR"),
+
+		avatarScheme: envChoice("AVATAR_SCHEME", "none", "gravatar", "identicon"),
+
+		awayAfter: envDuration("AWAY_AFTER", 5*time.Minute),
+
+		statsInterval: envDuration("STATS_INTERVAL", 0),
+
+		adminToken: os.Getenv("ADMIN_TOKEN"),
+
+		moderatorKey: os.Getenv("MODERATOR_KEY"),
+
+		corsAllowedMethods: envList("CORS_ALLOWED_METHODS"),
+		corsAllowedHeaders: envString("CORS_ALLOWED_HEADERS", "Content-Type, Authorization, X-Room-Password"),
+		corsMaxAge:         envDuration("CORS_MAX_AGE", 0),
+
+		readBufferSize:  envInt("READ_BUFFER_SIZE", 1024),
+		writeBufferSize: envInt("WRITE_BUFFER_SIZE", 1024),
+		writeBufferPool: envBool("WRITE_BUFFER_POOL", true),
+
+		maxConnections: envInt("MAX_CONNECTIONS", 0),
+
+		upgradeRate:      envFloat("UPGRADE_RATE", 0),
+		upgradeBurst:     envInt("UPGRADE_BURST", 10),
+		upgradeRateAllow: envNetworks("UPGRADE_RATE_ALLOW"),
+
+		roomCreateLimit:  envInt("ROOM_CREATE_LIMIT", 0),
+		roomCreateWindow: envDuration("ROOM_CREATE_WINDOW", time.Hour),
+
+		botMessageRate:  envFloat("BOT_MESSAGE_RATE", 0),
+		botMessageBurst: envInt("BOT_MESSAGE_BURST", 5),
+
+		trustedProxies: envNetworks("TRUSTED_PROXIES"),
+
+		ipHashSecret: ipHashSecret(),
+
+		backpressure: envChoice("BACKPRESSURE", "block", "drop_oldest", "drop_newest", "disconnect"),
+
+		fanoutMode:    envChoice("FANOUT_MODE", "strict", "fast"),
+		fanoutWorkers: envInt("FANOUT_WORKERS", runtime.GOMAXPROCS(0)),
+
+		auditLog: envBool("AUDIT_LOG", false),
+
+		connectionAnalytics: envChoice("CONNECTION_ANALYTICS", "off", "stats", "log"),
+		geoIPFile:           envString("GEOIP_CSV", ""),
+
+		logSampleBurst:     envInt("LOG_SAMPLE_BURST", 20),
+		logSampleRate:      envInt("LOG_SAMPLE_RATE", 100),
+		logSummaryInterval: envDuration("LOG_SUMMARY_INTERVAL", time.Minute),
+
+		historySize:        envInt("HISTORY_SIZE", 50),
+		historyReplayBytes: envInt("HISTORY_REPLAY_BYTES", 0),
+
+		ackCacheSize:   envInt("ACK_CACHE_SIZE", 100),
+		ackDedupWindow: envDuration("ACK_DEDUP_WINDOW", 2*time.Minute),
+
+		editWindow: envDuration("EDIT_WINDOW", 0),
+
+		historyDir:      envString("HISTORY_DIR", ""),
+		historyMaxBytes: int64(envInt("HISTORY_MAX_BYTES", 10<<20)),
+
+		historyKey:          os.Getenv("HISTORY_ENCRYPTION_KEY"),
+		historyOldKeys:      envList("HISTORY_ENCRYPTION_OLD_KEYS"),
+		historyEncryptRooms: envList("HISTORY_ENCRYPT_ROOMS"),
+
+		storeQueueSize:     envInt("STORE_QUEUE_SIZE", 1024),
+		storeQueuePolicy:   envChoice("STORE_QUEUE_POLICY", "block", "drop"),
+		storeBatchSize:     envInt("STORE_BATCH_SIZE", 100),
+		storeFlushInterval: envDuration("STORE_FLUSH_INTERVAL", time.Second),
+
+		storeBreakerThreshold: envInt("STORE_BREAKER_THRESHOLD", 5),
+		storeBreakerCooldown:  envDuration("STORE_BREAKER_COOLDOWN", 30*time.Second),
+
+		nickCooldown: envDuration("NICK_COOLDOWN", 30*time.Second),
+		nameReclaim:  envBool("NAME_RECLAIM", false),
+
+		subprotocolPolicy: envChoice("SUBPROTOCOL_POLICY", "reject", "fallback"),
+
+		joinQueueSize: envInt("JOIN_QUEUE_SIZE", 16),
+
+		batchWindow:  envDuration("BATCH_WINDOW", 0),
+		batchMaxSize: envInt("BATCH_MAX_SIZE", 32),
+
+		shutdownMode:          envChoice("SHUTDOWN_MODE", "drain", "hard"),
+		shutdownReadyDelay:    envDuration("SHUTDOWN_READY_DELAY", 0),
+		shutdownHTTPTimeout:   envDuration("SHUTDOWN_HTTP_TIMEOUT", 10*time.Second),
+		shutdownReconnectWait: envDuration("SHUTDOWN_RECONNECT_WAIT", 0),
+
+		passwordCooldown: envDuration("PASSWORD_COOLDOWN", time.Minute),
+
+		reconnectAfter:    envDuration("RECONNECT_AFTER", 5*time.Second),
+		reconnectLoadStep: envInt("RECONNECT_LOAD_STEP", 1000),
+		reconnectJitter:   envBool("RECONNECT_JITTER", true),
+
+		nameMode: envChoice("NAME_MODE", "anonymous", "mixed", "named"),
+
+		roomOrigins: envRoomOrigins("ROOM_ORIGINS"),
+		hookTokens:  envHookTokens("HOOK_TOKENS"),
+
+		sendQueueSize:  envInt("SEND_QUEUE_SIZE", messageBufferSize),
+		sendQueueSizes: envSendQueueSizes("SEND_QUEUE_SIZES"),
+
+		shutdownGrace: envDuration("SHUTDOWN_GRACE", 5*time.Second),
+
+		coalesceUpdates:  envBool("COALESCE_UPDATES", false),
+		coalesceInterval: envDuration("COALESCE_INTERVAL", 100*time.Millisecond),
+
+		receiptInterval: envDuration("RECEIPT_INTERVAL", time.Second),
+
+		forwardCreateRooms: envBool("FORWARD_CREATE_ROOMS", false),
+
+		unfurlLinks:   envBool("UNFURL_LINKS", false),
+		unfurlTimeout: envDuration("UNFURL_TIMEOUT", 5*time.Second),
+
+		maxMessageBytes:    int64(envInt("MAX_MESSAGE_BYTES", 64<<10)),
+		maxMessageRunes:    envInt("MAX_MESSAGE_RUNES", 4000),
+		messageRunesPolicy: envChoice("MESSAGE_RUNES_POLICY", "reject", "truncate"),
+
+		maxBlankLines:    envInt("MAX_BLANK_LINES", 2),
+		whitespacePolicy: envChoice("WHITESPACE_POLICY", "trim", "reject"),
+
+		emojiShortcodes: envBool("EMOJI_SHORTCODES", false),
+
+		markdown: envBool("MARKDOWN", false),
+
+		pollTimeout: envDuration("POLL_TIMEOUT", 0),
+
+		maxScheduledPerUser: envInt("MAX_SCHEDULED_PER_USER", 5),
+		maxScheduledPerRoom: envInt("MAX_SCHEDULED_PER_ROOM", 100),
+		maxScheduleDelay:    envDuration("MAX_SCHEDULE_DELAY", 24*time.Hour),
+		scheduleAfterLeave:  envBool("SCHEDULE_AFTER_LEAVE", true),
+
+		pingInterval: envDuration("PING_INTERVAL", 54*time.Second),
+		pongWait:     envDuration("PONG_WAIT", 60*time.Second),
+		writeWait:    envDuration("WRITE_WAIT", 10*time.Second),
+		tcpKeepAlive: envDuration("TCP_KEEPALIVE", 30*time.Second),
+	}
+
+	// a ping must have time to be answered before the client is given up on
+	if c.pingInterval <= 0 || c.pongWait <= c.pingInterval {
+		log.Printf("PONG_WAIT=%v must be longer than PING_INTERVAL=%v, using defaults", c.pongWait, c.pingInterval)
+		c.pingInterval, c.pongWait = 54*time.Second, 60*time.Second
+	}
+	if c.writeWait <= 0 {
+		log.Printf("invalid WRITE_WAIT=%v, using default 10s", c.writeWait)
+		c.writeWait = 10 * time.Second
+	}
+	// deliver relies on a buffer, an unbuffered queue would drop or block on every message
+	if c.sendQueueSize < 1 {
+		log.Printf("invalid SEND_QUEUE_SIZE=%d, using default %d", c.sendQueueSize, messageBufferSize)
+		c.sendQueueSize = messageBufferSize
+	}
+	if c.fanoutWorkers < 1 {
+		log.Printf("invalid FANOUT_WORKERS=%d, using default %d", c.fanoutWorkers, runtime.GOMAXPROCS(0))
+		c.fanoutWorkers = runtime.GOMAXPROCS(0)
+	}
+	return c
+}
+
+// ipHashSecret returns IP_HASH_SECRET, or a random secret when it is unset
+func ipHashSecret() []byte {
+	if secret := os.Getenv("IP_HASH_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	log.Println("IP_HASH_SECRET not set, using a random secret; per-IP keys will change on restart")
+	return []byte(rand.Text())
+}
+
+// envString returns the value of key, or def when it is unset
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envChoice returns key if it is one of the allowed values, falling back to
+// def (the first choice) when unset or invalid
+func envChoice(key, def string, others ...string) string {
+	v := os.Getenv(key)
+	if v == "" || v == def {
+		return def
+	}
+	for _, choice := range others {
+		if v == choice {
+			return v
+		}
+	}
+	log.Printf("invalid %s=%q, using default %v", key, v, def)
+	return def
+}
+
+// envBool parses key as a boolean, falling back to def when unset or invalid
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using default %v", key, v, def)
+		return def
+	}
+	return b
+}
+
+// envInt parses key as an integer, falling back to def when unset or invalid
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using default %v", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envFloat parses key as a float, falling back to def when unset or invalid
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("invalid %s=%q, using default %v", key, v, def)
+		return def
+	}
+	return f
+}
+
+// envList parses key as a comma separated list, ignoring blank entries
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envRoomOrigins parses key as per-room origin allowlists, see parseRoomOrigins
+func envRoomOrigins(key string) []roomOrigins {
+	list, err := parseRoomOrigins(os.Getenv(key))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return list
+}
+
+// envHookTokens parses key as per-room webhook tokens, see parseHookTokens
+func envHookTokens(key string) []hookToken {
+	list, err := parseHookTokens(os.Getenv(key))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return list
+}
+
+// envSendQueueSizes parses key as per-client queue sizes, see parseSendQueueSizes
+func envSendQueueSizes(key string) map[string]int {
+	sizes, err := parseSendQueueSizes(os.Getenv(key))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return sizes
+}
+
+// envBasePath parses key as a URL path prefix, adding the leading slash and
+// dropping the trailing one, so "chat-app/" becomes "/chat-app" and "/" none
+func envBasePath(key string) string {
+	p := strings.Trim(os.Getenv(key), "/")
+	if p == "" {
+		return ""
+	}
+	if u, err := url.Parse("/" + p); err != nil || u.Path != "/"+p || u.RawQuery != "" || u.Fragment != "" {
+		log.Fatalf("invalid %s: %q", key, os.Getenv(key))
+	}
+	return "/" + p
+}
+
+// envNetworks parses key as a comma separated list of IPs and CIDRs
+func envNetworks(key string) []*net.IPNet {
+	networks, err := parseNetworks(os.Getenv(key))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return networks
+}
+
+// envDuration parses key as a time.Duration (e.g. "5s"), falling back to def when unset or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using default %v", key, v, def)
+		return def
+	}
+	return d
+}
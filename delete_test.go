@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// two tabs joining as alice from one IP are different authors: neither can
+// delete the other's messages, each can delete its own
+func TestDeleteOnlyOwnMessagesFromOneIP(t *testing.T) {
+	r := newTestRoom(t, "delete-same-ip")
+	first := joinTestRoom(t, r, "alice")
+	second := joinTestRoom(t, r, "alice")
+	if first.identity == second.identity {
+		t.Fatalf("both clients have identity %q", first.identity)
+	}
+
+	first.send("from the first tab")
+	firstSeq := first.expect("message").Seq
+	second.expect("message")
+	second.send("from the second tab")
+	secondSeq := second.expect("message").Seq
+	first.expect("message")
+
+	for _, try := range []struct {
+		c   *testClient
+		seq uint64
+	}{{first, secondSeq}, {second, firstSeq}} {
+		try.c.send(fmt.Sprintf("/delete %d", try.seq))
+		if e := try.c.expect("error"); e.Code != errForbidden {
+			t.Fatalf("deleting the other tab's message got %+v, want %s", e, errForbidden)
+		}
+	}
+
+	for _, own := range []struct {
+		c   *testClient
+		seq uint64
+	}{{first, firstSeq}, {second, secondSeq}} {
+		own.c.send(fmt.Sprintf("/delete %d", own.seq))
+		for _, c := range []*testClient{first, second} {
+			if e := c.expect("delete"); e.Seq != own.seq {
+				t.Fatalf("got delete of %d, want %d", e.Seq, own.seq)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// edit handles {"type":"edit","seq":N,"message":"new text"} from a message's author
+func (r *room) edit(e *envelope) {
+	original := r.findMessage(e.Seq)
+	if original == nil {
+		r.reject(e.from, errNotFound, "message_not_found", e.Seq)
+		return
+	}
+	if original.author == "" || original.author != e.from.identity {
+		r.reject(e.from, errForbidden, "edit_not_author")
+		return
+	}
+	if cfg.editWindow > 0 && time.Since(time.UnixMilli(original.Time)) > cfg.editWindow {
+		r.reject(e.from, errEditWindow, "edit_window", cfg.editWindow)
+		return
+	}
+	if strings.TrimSpace(e.Message) == "" {
+		r.reject(e.from, errInvalidMessage, "edit_empty")
+		return
+	}
+	// the format stays as /shout or /code set it, and so do its rules
+	if original.Format == "shout" && utf8.RuneCountInString(e.Message) > maxShoutLen {
+		r.reject(e.from, errMessageTooLong, "shout_too_long", maxShoutLen)
+		return
+	}
+
+	// the history entry is updated in place so later replays show the edit
+	original.Message = e.Message
+	original.EditedAt = time.Now().UnixMilli()
+	if original.HTML != "" {
+		original.HTML = renderMarkdown(original.Message)
+	}
+
+	update := &envelope{
+		Type:     "edit",
+		Seq:      original.Seq,
+		Message:  original.Message,
+		HTML:     original.HTML,
+		EditedAt: original.EditedAt,
+	}
+	r.broadcast(update)
+	saveMessage(r.name, update)
+}
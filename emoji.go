@@ -0,0 +1,604 @@
+package main
+
+import "regexp"
+
+// shortcodePattern matches :name: style emoji shortcodes
+var shortcodePattern = regexp.MustCompile(`:[a-z0-9_+\-]+:`)
+
+// expandShortcodes replaces known emoji shortcodes in text with their Unicode
+// emoji, leaving unknown ones untouched so every client renders the same thing
+func expandShortcodes(text string) string {
+	return shortcodePattern.ReplaceAllStringFunc(text, func(code string) string {
+		if emoji, ok := shortcodes[code[1:len(code)-1]]; ok {
+			return emoji
+		}
+		return code
+	})
+}
+
+// shortcodes maps common GitHub/Slack style shortcodes to emoji
+var shortcodes = map[string]string{
+	"+1":                             "👍",
+	"-1":                             "👎",
+	"100":                            "💯",
+	"1st_place_medal":                "🥇",
+	"2nd_place_medal":                "🥈",
+	"3rd_place_medal":                "🥉",
+	"8ball":                          "🎱",
+	"airplane":                       "✈️",
+	"alarm_clock":                    "⏰",
+	"alien":                          "👽",
+	"ambulance":                      "🚑",
+	"anchor":                         "⚓",
+	"anger":                          "💢",
+	"angry":                          "😠",
+	"anguished":                      "😧",
+	"ant":                            "🐜",
+	"apple":                          "🍎",
+	"arrow_down":                     "⬇️",
+	"arrow_left":                     "⬅️",
+	"arrow_right":                    "➡️",
+	"arrow_up":                       "⬆️",
+	"arrows_counterclockwise":        "🔄",
+	"art":                            "🎨",
+	"asterisk":                       "*️⃣",
+	"astonished":                     "😲",
+	"avocado":                        "🥑",
+	"baby":                           "👶",
+	"baby_chick":                     "🐤",
+	"bacon":                          "🥓",
+	"badminton":                      "🏸",
+	"balloon":                        "🎈",
+	"ballot_box_with_check":          "☑️",
+	"banana":                         "🍌",
+	"bangbang":                       "‼️",
+	"bar_chart":                      "📊",
+	"baseball":                       "⚾",
+	"basketball":                     "🏀",
+	"bat":                            "🦇",
+	"battery":                        "🔋",
+	"bear":                           "🐻",
+	"bed":                            "🛏️",
+	"bee":                            "🐝",
+	"beer":                           "🍺",
+	"beers":                          "🍻",
+	"beetle":                         "🪲",
+	"bell":                           "🔔",
+	"bike":                           "🚲",
+	"bird":                           "🐦",
+	"birthday":                       "🎂",
+	"black_circle":                   "⚫",
+	"black_heart":                    "🖤",
+	"blossom":                        "🌼",
+	"blowfish":                       "🐡",
+	"blue_heart":                     "💙",
+	"blush":                          "😊",
+	"boar":                           "🐗",
+	"boat":                           "⛵",
+	"bomb":                           "💣",
+	"book":                           "📖",
+	"books":                          "📚",
+	"boom":                           "💥",
+	"bouquet":                        "💐",
+	"bow":                            "🙇",
+	"bowling":                        "🎳",
+	"boy":                            "👦",
+	"brain":                          "🧠",
+	"bread":                          "🍞",
+	"broccoli":                       "🥦",
+	"broken_heart":                   "💔",
+	"broom":                          "🧹",
+	"brown_heart":                    "🤎",
+	"bug":                            "🐛",
+	"bulb":                           "💡",
+	"burrito":                        "🌯",
+	"bus":                            "🚌",
+	"butterfly":                      "🦋",
+	"cactus":                         "🌵",
+	"cake":                           "🍰",
+	"calendar":                       "📆",
+	"call_me_hand":                   "🤙",
+	"camel":                          "🐫",
+	"camera":                         "📷",
+	"candle":                         "🕯️",
+	"candy":                          "🍬",
+	"car":                            "🚗",
+	"carrot":                         "🥕",
+	"cat":                            "🐱",
+	"cd":                             "💿",
+	"champagne":                      "🍾",
+	"chart_with_downwards_trend":     "📉",
+	"chart_with_upwards_trend":       "📈",
+	"checkered_flag":                 "🏁",
+	"cheese":                         "🧀",
+	"cherries":                       "🍒",
+	"cherry_blossom":                 "🌸",
+	"chess_pawn":                     "♟️",
+	"chicken":                        "🐔",
+	"chocolate_bar":                  "🍫",
+	"christmas_tree":                 "🎄",
+	"clap":                           "👏",
+	"clinking_glasses":               "🥂",
+	"clipboard":                      "📋",
+	"cloud":                          "☁️",
+	"clown_face":                     "🤡",
+	"cocktail":                       "🍸",
+	"coconut":                        "🥥",
+	"coffee":                         "☕",
+	"cold_face":                      "🥶",
+	"cold_sweat":                     "😰",
+	"collision":                      "💥",
+	"comet":                          "☄️",
+	"computer":                       "💻",
+	"confetti_ball":                  "🎊",
+	"confounded":                     "😖",
+	"confused":                       "😕",
+	"construction":                   "🚧",
+	"cookie":                         "🍪",
+	"cool":                           "🆒",
+	"copyright":                      "©️",
+	"corn":                           "🌽",
+	"couch_and_lamp":                 "🛋️",
+	"cow":                            "🐮",
+	"cowboy_hat_face":                "🤠",
+	"crab":                           "🦀",
+	"credit_card":                    "💳",
+	"crescent_moon":                  "🌙",
+	"crocodile":                      "🐊",
+	"croissant":                      "🥐",
+	"crossed_fingers":                "🤞",
+	"crossed_swords":                 "⚔️",
+	"cry":                            "😢",
+	"crying_cat_face":                "😿",
+	"crystal_ball":                   "🔮",
+	"cup_with_straw":                 "🥤",
+	"cupcake":                        "🧁",
+	"cupid":                          "💘",
+	"curry":                          "🍛",
+	"cursing_face":                   "🤬",
+	"dancer":                         "💃",
+	"dart":                           "🎯",
+	"dash":                           "💨",
+	"date":                           "📅",
+	"deciduous_tree":                 "🌳",
+	"desktop_computer":               "🖥️",
+	"disappointed":                   "😞",
+	"disappointed_relieved":          "😥",
+	"dizzy":                          "💫",
+	"dizzy_face":                     "😵",
+	"dna":                            "🧬",
+	"dog":                            "🐶",
+	"dollar":                         "💵",
+	"dolphin":                        "🐬",
+	"door":                           "🚪",
+	"doughnut":                       "🍩",
+	"dragon":                         "🐉",
+	"drooling_face":                  "🤤",
+	"droplet":                        "💧",
+	"drum":                           "🥁",
+	"duck":                           "🦆",
+	"dumpling":                       "🥟",
+	"eagle":                          "🦅",
+	"ear":                            "👂",
+	"earth_africa":                   "🌍",
+	"earth_americas":                 "🌎",
+	"earth_asia":                     "🌏",
+	"egg":                            "🥚",
+	"eggplant":                       "🍆",
+	"eight":                          "8️⃣",
+	"electric_plug":                  "🔌",
+	"elephant":                       "🐘",
+	"email":                          "📧",
+	"envelope":                       "✉️",
+	"evergreen_tree":                 "🌲",
+	"exclamation":                    "❗",
+	"exploding_head":                 "🤯",
+	"expressionless":                 "😑",
+	"eye":                            "👁️",
+	"eyes":                           "👀",
+	"face_with_head_bandage":         "🤕",
+	"face_with_thermometer":          "🤒",
+	"facepalm":                       "🤦",
+	"facepunch":                      "👊",
+	"fallen_leaf":                    "🍂",
+	"fearful":                        "😨",
+	"feet":                           "🐾",
+	"file_folder":                    "📁",
+	"fire":                           "🔥",
+	"fire_engine":                    "🚒",
+	"fireworks":                      "🎆",
+	"fish":                           "🐟",
+	"fist":                           "✊",
+	"fist_raised":                    "✊",
+	"five":                           "5️⃣",
+	"flashlight":                     "🔦",
+	"floppy_disk":                    "💾",
+	"flushed":                        "😳",
+	"fog":                            "🌫️",
+	"football":                       "🏈",
+	"footprints":                     "👣",
+	"four":                           "4️⃣",
+	"four_leaf_clover":               "🍀",
+	"fox_face":                       "🦊",
+	"free":                           "🆓",
+	"fries":                          "🍟",
+	"frog":                           "🐸",
+	"frowning":                       "😦",
+	"frowning_face":                  "☹️",
+	"fuelpump":                       "⛽",
+	"full_moon":                      "🌕",
+	"game_die":                       "🎲",
+	"gear":                           "⚙️",
+	"gem":                            "💎",
+	"ghost":                          "👻",
+	"gift":                           "🎁",
+	"gift_heart":                     "💝",
+	"giraffe":                        "🦒",
+	"girl":                           "👧",
+	"grapes":                         "🍇",
+	"green_apple":                    "🍏",
+	"green_circle":                   "🟢",
+	"green_heart":                    "💚",
+	"grey_exclamation":               "❕",
+	"grey_question":                  "❔",
+	"grimacing":                      "😬",
+	"grin":                           "😁",
+	"grinning":                       "😀",
+	"guitar":                         "🎸",
+	"hamburger":                      "🍔",
+	"hammer":                         "🔨",
+	"hammer_and_wrench":              "🛠️",
+	"hamster":                        "🐹",
+	"hand":                           "✋",
+	"hand_over_mouth":                "🤭",
+	"handshake":                      "🤝",
+	"hankey":                         "💩",
+	"hash":                           "#️⃣",
+	"headphones":                     "🎧",
+	"hear_no_evil":                   "🙉",
+	"heart":                          "❤️",
+	"heart_exclamation":              "❣️",
+	"heart_eyes":                     "😍",
+	"heart_eyes_cat":                 "😻",
+	"heartbeat":                      "💓",
+	"heartpulse":                     "💗",
+	"heavy_check_mark":               "✔️",
+	"heavy_minus_sign":               "➖",
+	"heavy_multiplication_x":         "✖️",
+	"heavy_plus_sign":                "➕",
+	"hedgehog":                       "🦔",
+	"helicopter":                     "🚁",
+	"herb":                           "🌿",
+	"hibiscus":                       "🌺",
+	"hole":                           "🕳️",
+	"honeybee":                       "🐝",
+	"horse":                          "🐴",
+	"hospital":                       "🏥",
+	"hot_face":                       "🥵",
+	"hot_pepper":                     "🌶️",
+	"hotdog":                         "🌭",
+	"hourglass":                      "⌛",
+	"house":                          "🏠",
+	"hugs":                           "🤗",
+	"hushed":                         "😯",
+	"ice_cream":                      "🍨",
+	"icecream":                       "🍦",
+	"imp":                            "👿",
+	"inbox_tray":                     "📥",
+	"infinity":                       "♾️",
+	"innocent":                       "😇",
+	"interrobang":                    "⁉️",
+	"iphone":                         "📱",
+	"jack_o_lantern":                 "🎃",
+	"japanese_ogre":                  "👹",
+	"jigsaw":                         "🧩",
+	"joy":                            "😂",
+	"joy_cat":                        "😹",
+	"joystick":                       "🕹️",
+	"kangaroo":                       "🦘",
+	"key":                            "🔑",
+	"keyboard":                       "⌨️",
+	"keycap_ten":                     "🔟",
+	"kiss":                           "💋",
+	"kissing":                        "😗",
+	"kissing_closed_eyes":            "😚",
+	"kissing_heart":                  "😘",
+	"kissing_smiling_eyes":           "😙",
+	"kiwi_fruit":                     "🥝",
+	"koala":                          "🐨",
+	"large_blue_circle":              "🔵",
+	"laughing":                       "😆",
+	"lemon":                          "🍋",
+	"link":                           "🔗",
+	"lion":                           "🦁",
+	"lips":                           "👄",
+	"lizard":                         "🦎",
+	"lock":                           "🔒",
+	"lollipop":                       "🍭",
+	"love_you_gesture":               "🤟",
+	"lying_face":                     "🤥",
+	"mag":                            "🔍",
+	"mage":                           "🧙",
+	"magnet":                         "🧲",
+	"mailbox":                        "📫",
+	"man":                            "👨",
+	"man_dancing":                    "🕺",
+	"mango":                          "🥭",
+	"maple_leaf":                     "🍁",
+	"mask":                           "😷",
+	"medal_sports":                   "🏅",
+	"melon":                          "🍈",
+	"memo":                           "📝",
+	"metal":                          "🤘",
+	"metro":                          "🚇",
+	"microphone":                     "🎤",
+	"microscope":                     "🔬",
+	"milk_glass":                     "🥛",
+	"money_mouth_face":               "🤑",
+	"moneybag":                       "💰",
+	"monkey":                         "🐒",
+	"monkey_face":                    "🐵",
+	"monocle_face":                   "🧐",
+	"motorcycle":                     "🏍️",
+	"mouse":                          "🐭",
+	"mouse_three_button":             "🖱️",
+	"movie_camera":                   "🎥",
+	"muscle":                         "💪",
+	"mushroom":                       "🍄",
+	"musical_keyboard":               "🎹",
+	"musical_note":                   "🎵",
+	"nail_care":                      "💅",
+	"nauseated_face":                 "🤢",
+	"nerd_face":                      "🤓",
+	"neutral_face":                   "😐",
+	"new":                            "🆕",
+	"new_moon":                       "🌑",
+	"nine":                           "9️⃣",
+	"ninja":                          "🥷",
+	"no_bell":                        "🔕",
+	"no_entry":                       "⛔",
+	"no_entry_sign":                  "🚫",
+	"no_good":                        "🙅",
+	"no_mouth":                       "😶",
+	"nose":                           "👃",
+	"notes":                          "🎶",
+	"o":                              "⭕",
+	"ocean":                          "🌊",
+	"octopus":                        "🐙",
+	"office":                         "🏢",
+	"ok":                             "🆗",
+	"ok_hand":                        "👌",
+	"ok_woman":                       "🙆",
+	"older_man":                      "👴",
+	"older_woman":                    "👵",
+	"one":                            "1️⃣",
+	"open_file_folder":               "📂",
+	"open_hands":                     "👐",
+	"open_mouth":                     "😮",
+	"orange_circle":                  "🟠",
+	"orange_heart":                   "🧡",
+	"otter":                          "🦦",
+	"outbox_tray":                    "📤",
+	"owl":                            "🦉",
+	"package":                        "📦",
+	"palm_tree":                      "🌴",
+	"palms_up_together":              "🤲",
+	"pancakes":                       "🥞",
+	"panda_face":                     "🐼",
+	"paperclip":                      "📎",
+	"partying_face":                  "🥳",
+	"paw_prints":                     "🐾",
+	"peach":                          "🍑",
+	"pear":                           "🍐",
+	"pen":                            "🖊️",
+	"pencil":                         "📝",
+	"pencil2":                        "✏️",
+	"penguin":                        "🐧",
+	"pensive":                        "😔",
+	"persevere":                      "😣",
+	"person_tipping_hand":            "💁",
+	"phone":                          "☎️",
+	"pig":                            "🐷",
+	"pill":                           "💊",
+	"pinched_fingers":                "🤌",
+	"pinching_hand":                  "🤏",
+	"pineapple":                      "🍍",
+	"ping_pong":                      "🏓",
+	"pirate_flag":                    "🏴‍☠️",
+	"pizza":                          "🍕",
+	"pleading_face":                  "🥺",
+	"point_down":                     "👇",
+	"point_left":                     "👈",
+	"point_right":                    "👉",
+	"point_up":                       "☝️",
+	"point_up_2":                     "👆",
+	"police_car":                     "🚓",
+	"poop":                           "💩",
+	"popcorn":                        "🍿",
+	"potato":                         "🥔",
+	"pout":                           "😡",
+	"pray":                           "🙏",
+	"printer":                        "🖨️",
+	"punch":                          "👊",
+	"purple_circle":                  "🟣",
+	"purple_heart":                   "💜",
+	"pushpin":                        "📌",
+	"question":                       "❓",
+	"rabbit":                         "🐰",
+	"radio":                          "📻",
+	"rage":                           "😡",
+	"rainbow":                        "🌈",
+	"rainbow_flag":                   "🏳️‍🌈",
+	"raised_back_of_hand":            "🤚",
+	"raised_eyebrow":                 "🤨",
+	"raised_hand":                    "✋",
+	"raised_hands":                   "🙌",
+	"raising_hand":                   "🙋",
+	"ramen":                          "🍜",
+	"recycle":                        "♻️",
+	"red_car":                        "🚗",
+	"red_circle":                     "🔴",
+	"registered":                     "®️",
+	"relaxed":                        "☺️",
+	"relieved":                       "😌",
+	"revolving_hearts":               "💞",
+	"ribbon":                         "🎀",
+	"rice":                           "🍚",
+	"robot":                          "🤖",
+	"rocket":                         "🚀",
+	"rofl":                           "🤣",
+	"roll_eyes":                      "🙄",
+	"rose":                           "🌹",
+	"round_pushpin":                  "📍",
+	"runner":                         "🏃",
+	"running":                        "🏃",
+	"sandwich":                       "🥪",
+	"santa":                          "🎅",
+	"satellite":                      "📡",
+	"satisfied":                      "😆",
+	"sauropod":                       "🦕",
+	"school":                         "🏫",
+	"scissors":                       "✂️",
+	"scorpion":                       "🦂",
+	"scream":                         "😱",
+	"scream_cat":                     "🙀",
+	"see_no_evil":                    "🙈",
+	"seedling":                       "🌱",
+	"selfie":                         "🤳",
+	"seven":                          "7️⃣",
+	"shark":                          "🦈",
+	"shield":                         "🛡️",
+	"ship":                           "🚢",
+	"shopping_cart":                  "🛒",
+	"shrimp":                         "🦐",
+	"shrug":                          "🤷",
+	"shushing_face":                  "🤫",
+	"six":                            "6️⃣",
+	"skull":                          "💀",
+	"sleeping":                       "😴",
+	"sleepy":                         "😪",
+	"slightly_frowning_face":         "🙁",
+	"slightly_smiling_face":          "🙂",
+	"sloth":                          "🦥",
+	"smile":                          "😄",
+	"smile_cat":                      "😸",
+	"smiley":                         "😃",
+	"smiley_cat":                     "😺",
+	"smiling_face_with_three_hearts": "🥰",
+	"smiling_imp":                    "😈",
+	"smirk":                          "😏",
+	"snail":                          "🐌",
+	"snake":                          "🐍",
+	"sneezing_face":                  "🤧",
+	"snowflake":                      "❄️",
+	"soap":                           "🧼",
+	"sob":                            "😭",
+	"soccer":                         "⚽",
+	"sos":                            "🆘",
+	"spaghetti":                      "🍝",
+	"sparkler":                       "🎇",
+	"sparkles":                       "✨",
+	"sparkling_heart":                "💖",
+	"speak_no_evil":                  "🙊",
+	"speech_balloon":                 "💬",
+	"spider":                         "🕷️",
+	"squid":                          "🦑",
+	"star":                           "⭐",
+	"star2":                          "🌟",
+	"statue_of_liberty":              "🗽",
+	"stopwatch":                      "⏱️",
+	"strawberry":                     "🍓",
+	"stuck_out_tongue":               "😛",
+	"stuck_out_tongue_closed_eyes":   "😝",
+	"stuck_out_tongue_winking_eye":   "😜",
+	"sunflower":                      "🌻",
+	"sunglasses":                     "😎",
+	"sunny":                          "☀️",
+	"superhero":                      "🦸",
+	"sushi":                          "🍣",
+	"sweat":                          "😓",
+	"sweat_drops":                    "💦",
+	"sweat_smile":                    "😅",
+	"syringe":                        "💉",
+	"t-rex":                          "🦖",
+	"taco":                           "🌮",
+	"tada":                           "🎉",
+	"tangerine":                      "🍊",
+	"taxi":                           "🚕",
+	"tea":                            "🍵",
+	"telephone_receiver":             "📞",
+	"telescope":                      "🔭",
+	"tennis":                         "🎾",
+	"tent":                           "⛺",
+	"test_tube":                      "🧪",
+	"thinking":                       "🤔",
+	"thought_balloon":                "💭",
+	"three":                          "3️⃣",
+	"thumbsdown":                     "👎",
+	"thumbsup":                       "👍",
+	"tiger":                          "🐯",
+	"tired_face":                     "😫",
+	"tm":                             "™️",
+	"toilet_paper":                   "🧻",
+	"tomato":                         "🍅",
+	"tongue":                         "👅",
+	"tornado":                        "🌪️",
+	"train":                          "🚆",
+	"triangular_flag_on_post":        "🚩",
+	"triumph":                        "😤",
+	"trophy":                         "🏆",
+	"tropical_drink":                 "🍹",
+	"tropical_fish":                  "🐠",
+	"truck":                          "🚚",
+	"trumpet":                        "🎺",
+	"tulip":                          "🌷",
+	"turtle":                         "🐢",
+	"tv":                             "📺",
+	"two":                            "2️⃣",
+	"two_hearts":                     "💕",
+	"umbrella":                       "☔",
+	"unamused":                       "😒",
+	"unicorn":                        "🦄",
+	"unlock":                         "🔓",
+	"up":                             "🆙",
+	"upside_down_face":               "🙃",
+	"v":                              "✌️",
+	"video_camera":                   "📹",
+	"video_game":                     "🎮",
+	"violin":                         "🎻",
+	"volleyball":                     "🏐",
+	"vomiting_face":                  "🤮",
+	"vulcan_salute":                  "🖖",
+	"walking":                        "🚶",
+	"warning":                        "⚠️",
+	"wastebasket":                    "🗑️",
+	"watch":                          "⌚",
+	"watermelon":                     "🍉",
+	"wave":                           "👋",
+	"weary":                          "😩",
+	"whale":                          "🐳",
+	"white_check_mark":               "✅",
+	"white_circle":                   "⚪",
+	"white_flag":                     "🏳️",
+	"white_heart":                    "🤍",
+	"wine_glass":                     "🍷",
+	"wink":                           "😉",
+	"wolf":                           "🐺",
+	"woman":                          "👩",
+	"woozy_face":                     "🥴",
+	"world_map":                      "🗺️",
+	"worried":                        "😟",
+	"wrench":                         "🔧",
+	"writing_hand":                   "✍️",
+	"x":                              "❌",
+	"yawning_face":                   "🥱",
+	"yellow_circle":                  "🟡",
+	"yellow_heart":                   "💛",
+	"yum":                            "😋",
+	"zany_face":                      "🤪",
+	"zap":                            "⚡",
+	"zero":                           "0️⃣",
+	"zipper_mouth_face":              "🤐",
+	"zombie":                         "🧟",
+	"zzz":                            "💤",
+}
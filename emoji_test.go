@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestExpandShortcodes(t *testing.T) {
+	tests := []struct{ text, want string }{
+		{"hello :smile:", "hello 😄"},
+		{":+1::tada:", "👍🎉"},
+		{"a:heart:b", "a❤️b"},
+		{":no_such_emoji:", ":no_such_emoji:"},
+		{"ratio 1:2:3", "ratio 1:2:3"},
+		{":SMILE:", ":SMILE:"},
+	}
+	for _, tt := range tests {
+		if got := expandShortcodes(tt.text); got != tt.want {
+			t.Errorf("expandShortcodes(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// shortcodes are only expanded when enabled, and never in /code or a
+// /setpass password
+func TestPrepareTextShortcodes(t *testing.T) {
+	tests := []struct {
+		enabled    bool
+		text, want string
+	}{
+		{false, "hi :smile:", "hi :smile:"},
+		{true, "hi :smile:", "hi 😄"},
+		{true, "/code x := y[:smile:]", "/code x := y[:smile:]"},
+		{true, "/code\n:smile:", "/code\n:smile:"},
+		{true, "/shout :smile:", "/shout 😄"},
+		{true, "/codex :smile:", "/codex 😄"},
+		{true, "/setpass a:smile:b", "/setpass a:smile:b"},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *config) {
+			c.emojiShortcodes = tt.enabled
+		})
+		got, _, rejected := prepareText(tt.text)
+		if rejected != nil || got != tt.want {
+			t.Errorf("prepareText(%q) with shortcodes %v = %q, %v, want %q", tt.text, tt.enabled, got, rejected, tt.want)
+		}
+	}
+}
+
+func TestShortcodesOffByDefault(t *testing.T) {
+	t.Setenv("EMOJI_SHORTCODES", "")
+	if loadConfig().emojiShortcodes {
+		t.Error("EMOJI_SHORTCODES defaults to on")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import "encoding/json"
+
+// envelope is the JSON message broadcast to clients
+type envelope struct {
+	// message kind: "message" for chat, "preview" for link previews,
+	// "poll" for poll tallies, "system" for server notices and "error" for
+	// rejected requests
+	Type string `json:"type"`
+
+	// wire format version, set on everything sent to v2 clients
+	V int `json:"v,omitempty"`
+
+	// sequence number assigned by the room to each chat message
+	Seq uint64 `json:"seq,omitempty"`
+
+	// unix millis at which the room accepted the message
+	Time int64 `json:"time,omitempty"`
+
+	// Time formatted in the receiving client's ?tz= timezone, if it set one
+	TimeText string `json:"timeText,omitempty"`
+
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// set on messages and presence of clients that connected as bots
+	Bot bool `json:"bot,omitempty"`
+
+	// avatar image of Name on messages and presence, see avatarURL
+	Avatar string `json:"avatar,omitempty"`
+
+	// Message rendered from Markdown to sanitized HTML when MARKDOWN is
+	// enabled, never taken from clients
+	HTML string `json:"html,omitempty"`
+
+	// how the frontend should style Message: "shout" or "code", see formatCommand
+	Format string `json:"format,omitempty"`
+
+	// id chosen by the sender of a "message" frame, echoed back in its "ack"
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+
+	// set on history entries whose message was deleted
+	Deleted bool `json:"deleted,omitempty"`
+
+	// set by the sender on messages only meant for who is connected now:
+	// they are never kept in history, stored or passed to hooks
+	Ephemeral bool `json:"ephemeral,omitempty"`
+
+	// unix millis of the last edit, zero if the message was never edited
+	EditedAt int64 `json:"editedAt,omitempty"`
+
+	// presence of Name in "presence" messages: "online" or "away"
+	Status string `json:"status,omitempty"`
+
+	// why the server is closing the connection in a "closing" message,
+	// "archived" or "shutdown"
+	Reason string `json:"reason,omitempty"`
+
+	// machine readable code of "error" messages, see errors.go
+	Code string `json:"code,omitempty"`
+
+	// set on messages forwarded from another room, Room is the source room;
+	// on "room" messages Room is the room's new name and Previous its old one
+	Forwarded bool   `json:"forwarded,omitempty"`
+	Room      string `json:"room,omitempty"`
+
+	// link preview metadata, Seq refers to the message containing the link
+	URL         string `json:"url,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+
+	// poll state, Option is the index voted for in a "vote" frame
+	PollID   int      `json:"pollId,omitempty"`
+	Question string   `json:"question,omitempty"`
+	Options  []string `json:"options,omitempty"`
+	Counts   []int    `json:"counts,omitempty"`
+	Closed   bool     `json:"closed,omitempty"`
+	Option   *int     `json:"option,omitempty"`
+
+	// last seq seen by each client name, in "receipts" messages
+	Receipts map[string]uint64 `json:"receipts,omitempty"`
+
+	// the joining client's own details in its "welcome" message: its
+	// session token, display color and the number of users in the room
+	Session string `json:"session,omitempty"`
+	Color   string `json:"color,omitempty"`
+	Users   int    `json:"users,omitempty"`
+
+	// chat messages sent in the last minute, in periodic "stats" messages
+	MessagesPerMin *int `json:"messagesPerMin,omitempty"`
+
+	// scheduled messages: At is the unix millis to send at, ID identifies
+	// the pending message for cancellation
+	At int64 `json:"at,omitempty"`
+	ID int   `json:"id,omitempty"`
+
+	// "reconnect" hints: milliseconds to wait before reconnecting, and
+	// whether to add a random delay of up to as much again
+	After  int64 `json:"after,omitempty"`
+	Jitter bool  `json:"jitter,omitempty"`
+
+	// the name a client had before a "rename", or the room before a "room"
+	Previous string `json:"previous,omitempty"`
+
+	// the client that sent this message, nil for server generated ones and
+	// for messages in the history, which must not keep clients alive
+	from *client
+
+	// read from the client's connection by read(), rather than queued for
+	// it by the server like scheduled messages and notices
+	received bool
+
+	// identity of the client that sent a chat message, kept in the history
+	// and the store but never sent; empty for server generated messages
+	author string
+
+	// system message key and arguments for internal "notify" envelopes
+	key  string
+	args []any
+}
+
+// legacyMessage is the v1 wire format, chat text only
+type legacyMessage struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// newMessage builds a chat message envelope
+func newMessage(name, text string) *envelope {
+	return &envelope{Type: "message", Name: name, Message: text}
+}
+
+// clientTypes are the envelope types clients may send as JSON frames,
+// anything else is treated as plain chat text
+var clientTypes = map[string]bool{
+	"message":    true,
+	"vote":       true,
+	"seen":       true,
+	"edit":       true,
+	"schedule":   true,
+	"unschedule": true,
+}
+
+// clientFrame holds the fields a client may set in a structured frame.
+// Frames are decoded into it rather than into envelope, so fields only the
+// server sets, like html, format or forwarded, can't be forged.
+type clientFrame struct {
+	Type        string `json:"type"`
+	Message     string `json:"message"`
+	ClientMsgID string `json:"clientMsgId"`
+	Ephemeral   bool   `json:"ephemeral"`
+
+	// the message an "edit" or "seen" refers to
+	Seq uint64 `json:"seq"`
+
+	// the poll and option of a "vote"
+	PollID int  `json:"pollId"`
+	Option *int `json:"option"`
+
+	// send time of a "schedule", and the pending message of an "unschedule"
+	At int64 `json:"at"`
+	ID int   `json:"id"`
+}
+
+// parseFrame decodes a structured frame sent by a client, or returns nil
+// when msg is plain text
+func parseFrame(msg []byte) *envelope {
+	if len(msg) == 0 || msg[0] != '{' {
+		return nil
+	}
+	var f clientFrame
+	if err := json.Unmarshal(msg, &f); err != nil || !clientTypes[f.Type] {
+		return nil
+	}
+	return &envelope{
+		Type:        f.Type,
+		Message:     f.Message,
+		ClientMsgID: f.ClientMsgID,
+		Ephemeral:   f.Ephemeral,
+		Seq:         f.Seq,
+		PollID:      f.PollID,
+		Option:      f.Option,
+		At:          f.At,
+		ID:          f.ID,
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fields only the server sets are dropped from client frames
+func TestParseFrameDropsServerFields(t *testing.T) {
+	e := parseFrame([]byte(`{"type":"message","message":"hi","html":"<script>","format":"code","forwarded":true,"room":"x","name":"system","session":"s","deleted":true}`))
+	if e == nil {
+		t.Fatal("frame was not parsed")
+	}
+	if e.HTML != "" || e.Format != "" || e.Forwarded || e.Room != "" || e.Name != "" || e.Session != "" || e.Deleted || e.Message != "hi" {
+		t.Errorf("parseFrame kept server fields: %+v", e)
+	}
+}
+
+// only /shout and /code set a message's format
+func TestFormatOnlyFromCommands(t *testing.T) {
+	r := newTestRoom(t, "format")
+	alice := joinTestRoom(t, r, "alice")
+
+	alice.send(`{"type":"message","message":"plain","format":"shout"}`)
+	if e := alice.expect("message"); e.Format != "" {
+		t.Errorf("a frame set format %q", e.Format)
+	}
+	alice.send("/code x := 1")
+	if e := alice.expect("message"); e.Format != "code" || e.Message != "x := 1" {
+		t.Errorf("/code got %+v", e)
+	}
+	alice.send("/shout hey")
+	shout := alice.expect("message")
+	if shout.Format != "shout" {
+		t.Errorf("/shout got %+v", shout)
+	}
+
+	alice.send(fmt.Sprintf(`{"type":"edit","seq":%d,"message":"%s"}`, shout.Seq, strings.Repeat("a", maxShoutLen+1)))
+	if e := alice.expect("error"); e.Code != errMessageTooLong {
+		t.Errorf("editing a shout past its limit got %+v", e)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+// stable codes of "error" messages, clients can rely on these rather than
+// on the translated text
+const (
+	errInvalidCommand  = "INVALID_COMMAND"
+	errInvalidMessage  = "INVALID_MESSAGE"
+	errMessageTooLong  = "MESSAGE_TOO_LONG"
+	errRateLimited     = "RATE_LIMITED"
+	errRoomPaused      = "ROOM_PAUSED"
+	errForbidden       = "FORBIDDEN"
+	errNotFound        = "NOT_FOUND"
+	errLimitReached    = "LIMIT_REACHED"
+	errEditWindow      = "EDIT_WINDOW_EXPIRED"
+	errPollClosed      = "POLL_CLOSED"
+	errNameTaken       = "NAME_TAKEN"
+	errCommandDisabled = "COMMAND_DISABLED"
+	errTypeNotAllowed  = "TYPE_NOT_ALLOWED"
+	errInvalidPassword = "INVALID_PASSWORD"
+)
+
+// reject tells a client its request was refused, as
+// {"type":"error","code":"...","message":"..."} in the client's language
+func (r *room) reject(c *client, code, key string, args ...any) {
+	r.send(c, &envelope{Type: "error", Code: code, Message: translate(c.lang, key, args...)})
+}
+
+// reject asks the room to send this client an error, see room.reject
+func (c *client) reject(code, key string, args ...any) {
+	c.room.submit(&envelope{Type: "notify", from: c, Code: code, key: key, args: args})
+}
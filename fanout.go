@@ -0,0 +1,104 @@
+package main
+
+import "github.com/gorilla/websocket"
+
+// fanoutQueueSize is how many events' worth of deliveries a worker may fall
+// behind run() before run() waits for it
+const fanoutQueueSize = 256
+
+// fanoutOp is a message to queue for a client, or its receive channel to
+// close once everything before it has been queued
+type fanoutOp struct {
+	c     *client
+	msg   []byte
+	close bool
+}
+
+// fanoutWorker delivers to its share of a room's clients with
+// FANOUT_MODE=fast. It is the only goroutine sending on those clients'
+// receive channels, so each client still gets messages in the order the
+// room handled them, but a client that is slow to read only holds up the
+// worker it belongs to rather than the whole room.
+type fanoutWorker struct {
+	queue chan []fanoutOp
+
+	// deliveries queued by the current event, only touched by run() and
+	// handed to the worker by flushFanout
+	batch []fanoutOp
+}
+
+// startFanout starts the room's fanout workers in fast mode
+func (r *room) startFanout() {
+	if cfg.fanoutMode != "fast" {
+		return
+	}
+	for range cfg.fanoutWorkers {
+		w := &fanoutWorker{queue: make(chan []fanoutOp, fanoutQueueSize)}
+		r.fanout = append(r.fanout, w)
+		go w.run(r)
+	}
+}
+
+// assignWorker spreads joining clients over the workers round robin,
+// called from run()
+func (r *room) assignWorker(c *client) {
+	if len(r.fanout) == 0 {
+		return
+	}
+	c.worker = r.fanout[r.nextWorker%len(r.fanout)]
+	r.nextWorker++
+}
+
+// flushFanout hands the deliveries queued by the last event to the workers,
+// waiting for any that are fanoutQueueSize events behind; called from run()
+func (r *room) flushFanout() {
+	for _, w := range r.fanout {
+		if len(w.batch) > 0 {
+			w.queue <- w.batch
+			w.batch = nil
+		}
+	}
+}
+
+// stopFanout lets the workers finish what is queued and exit, called from
+// run() as the room stops
+func (r *room) stopFanout() {
+	r.flushFanout()
+	for _, w := range r.fanout {
+		close(w.queue)
+	}
+}
+
+func (w *fanoutWorker) run(r *room) {
+	// clients given up on under BACKPRESSURE=disconnect, skipped until the
+	// room has removed them
+	slow := make(map[*client]bool)
+	for batch := range w.queue {
+		for _, op := range batch {
+			switch {
+			case op.close:
+				delete(slow, op.c)
+				close(op.c.receive)
+			case slow[op.c]:
+			case !queue(op.c, op.msg):
+				slow[op.c] = true
+				c := op.c
+				// the room may be waiting on this worker, so don't wait for it
+				go r.do(func() {
+					r.dropSlow(c)
+				})
+			}
+		}
+	}
+}
+
+// dropSlow disconnects a client that fell too far behind with
+// BACKPRESSURE=disconnect, called from run()
+func (r *room) dropSlow(c *client) {
+	if !r.clients[c] {
+		return
+	}
+	slowDisconnects.Add(1)
+	logSlowClient(r.name, c.name)
+	r.remove(c, websocket.CloseTryAgainLater, "slow")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// with FANOUT_MODE=fast every client still sees messages in the order the
+// room handled them, while several senders post at once and a slow client
+// holds up its worker
+func TestFastFanoutKeepsOrderPerClient(t *testing.T) {
+	withConfig(t, func(c *config) {
+		c.fanoutMode = "fast"
+		c.fanoutWorkers = 3
+		c.backpressure = "block"
+		c.sendQueueSize = 4
+	})
+	r := newTestRoom(t, "fanout-order")
+	var clients []*testClient
+	for i := range 8 {
+		clients = append(clients, joinTestRoom(t, r, fmt.Sprintf("user%d", i)))
+	}
+	// fewer messages than fanoutQueueSize, so the room never has to wait
+	// for the slow client's worker
+	senders := clients[:3]
+	const perSender = 60
+
+	slow := clients[len(clients)-1]
+	slow.fake.stick()
+	done := make(chan struct{})
+	for _, s := range senders {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for i := range perSender {
+				select {
+				case s.fake.in <- []byte(s.name + " " + strconv.Itoa(i)):
+				case <-s.fake.closed:
+					return
+				}
+			}
+		}()
+	}
+	for range senders {
+		<-done
+	}
+	slow.fake.unstick()
+
+	for _, c := range clients {
+		var lastSeq uint64
+		last := make(map[string]int)
+		for range len(senders) * perSender {
+			e := c.expect("message")
+			if e.Seq <= lastSeq {
+				t.Fatalf("%s got seq %d after %d", c.name, e.Seq, lastSeq)
+			}
+			lastSeq = e.Seq
+			sender, n, _ := strings.Cut(e.Message, " ")
+			i, _ := strconv.Atoi(n)
+			if prev, ok := last[sender]; ok && i != prev+1 {
+				t.Fatalf("%s got %q after %s %d", c.name, e.Message, sender, prev)
+			}
+			last[sender] = i
+		}
+	}
+}
@@ -1,7 +1,9 @@
 module real_time_chat_app
 
-go 1.25
+go 1.25.0
 
 require github.com/gorilla/websocket v1.5.3
 
 require github.com/joho/godotenv v1.5.1
+
+require golang.org/x/crypto v0.54.0
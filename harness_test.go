@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// how long a test waits for a frame before giving up
+const testTimeout = 2 * time.Second
+
+func TestMain(m *testing.M) {
+	cfg = loadConfig()
+	storeBreaker = newCircuitBreaker("store", cfg.storeBreakerThreshold, cfg.storeBreakerCooldown)
+	os.Exit(m.Run())
+}
+
+// withConfig changes cfg for the rest of the test
+func withConfig(t testing.TB, change func(c *config)) {
+	old := cfg
+	t.Cleanup(func() {
+		cfg = old
+	})
+	change(&cfg)
+}
+
+// withStore keeps history in a jsonlStore in a temporary directory for the
+// rest of the test. Saved messages wait in storeQueue until flushStore.
+func withStore(t testing.TB) {
+	t.Helper()
+	s, err := newJSONLStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore, oldQueue := store, storeQueue
+	t.Cleanup(func() {
+		store, storeQueue = oldStore, oldQueue
+	})
+	store, storeQueue = s, make(chan storedMessage, 1024)
+}
+
+// flushStore saves everything queued so far, as the store writer would
+func flushStore(t testing.TB) {
+	t.Helper()
+	var batch []storedMessage
+	for len(storeQueue) > 0 {
+		batch = append(batch, <-storeQueue)
+	}
+	if err := store.Save(batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeTransport is an in-memory Transport. Tests play the browser: frames
+// passed to send are read by the client, frames the server writes arrive
+// on out. While stuck, writes block like a client that stopped reading.
+// A value sent on panics makes the pending Read panic with it.
+type fakeTransport struct {
+	in     chan []byte
+	out    chan []byte
+	panics chan any
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	stuck chan struct{}
+	// close frame written by the server, zero until there is one
+	closeCode int
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		in:     make(chan []byte),
+		out:    make(chan []byte, 1024),
+		panics: make(chan any),
+		closed: make(chan struct{}),
+	}
+}
+
+// Read returns the next frame sent, and a normal close once the test left
+func (t *fakeTransport) Read() ([]byte, error) {
+	select {
+	case msg, ok := <-t.in:
+		if !ok {
+			return nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}
+		}
+		return msg, nil
+	case v := <-t.panics:
+		panic(v)
+	case <-t.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *fakeTransport) Write(msg []byte) error {
+	t.mu.Lock()
+	stuck := t.stuck
+	t.mu.Unlock()
+	if stuck != nil {
+		select {
+		case <-stuck:
+		case <-t.closed:
+			return net.ErrClosed
+		}
+	}
+	select {
+	case t.out <- msg:
+		return nil
+	case <-t.closed:
+		return net.ErrClosed
+	}
+}
+
+func (t *fakeTransport) Ping() error                      { return nil }
+func (t *fakeTransport) OnPong(f func())                  {}
+func (t *fakeTransport) SetReadDeadline(time.Time) error  { return nil }
+func (t *fakeTransport) SetWriteDeadline(time.Time) error { return nil }
+
+func (t *fakeTransport) WriteClose(code int, reason string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeCode = code
+	return nil
+}
+
+func (t *fakeTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
+
+// stick makes writes block until unstick is called
+func (t *fakeTransport) stick() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stuck == nil {
+		t.stuck = make(chan struct{})
+	}
+}
+
+func (t *fakeTransport) unstick() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stuck != nil {
+		close(t.stuck)
+		t.stuck = nil
+	}
+}
+
+// testRoom is a room opened for a test
+type testRoom struct {
+	*room
+
+	// read() and write() of the clients joined with joinTestRoom
+	clients sync.WaitGroup
+}
+
+// newTestRoom opens a room through getRoom. When the test ends, after the
+// clients' connections are closed, it is closed and waited for together
+// with every client goroutine, which read cfg that withConfig restores.
+func newTestRoom(t testing.TB, name string) *testRoom {
+	t.Helper()
+	r := &testRoom{room: getRoom(name)}
+	t.Cleanup(func() {
+		closeRoom(r.room, "")
+		<-r.quit
+		r.clients.Wait()
+	})
+	return r
+}
+
+// testClient is a client connected to a room over a fakeTransport, with
+// read() and write() running as they do for a real connection
+type testClient struct {
+	*client
+	fake *fakeTransport
+	t    testing.TB
+}
+
+// joinTestRoom connects a client named name to r and waits for its welcome
+func joinTestRoom(t testing.TB, r *testRoom, name string) *testClient {
+	t.Helper()
+	fake := newFakeTransport()
+	c := &client{
+		transport: fake,
+		room:      r.room,
+		receive:   make(chan []byte, sendQueueSize("", false, false)),
+		done:      make(chan struct{}),
+		name:      name,
+		color:     nameColor(name),
+		session:   rand.Text(),
+		version:   wireV2,
+		ip:        "test",
+	}
+	if !r.enter(c) {
+		t.Fatalf("room %q refused %s", r.name, name)
+	}
+	r.clients.Add(2)
+	go func() {
+		defer r.clients.Done()
+		c.write()
+	}()
+	go func() {
+		defer r.clients.Done()
+		c.read()
+		r.exit(c)
+	}()
+	tc := &testClient{client: c, fake: fake, t: t}
+	t.Cleanup(func() {
+		fake.unstick()
+		fake.Close()
+	})
+	tc.expect("welcome")
+	return tc
+}
+
+// send delivers a frame from the client to the server
+func (tc *testClient) send(frame string) {
+	tc.t.Helper()
+	select {
+	case tc.fake.in <- []byte(frame):
+	case <-time.After(testTimeout):
+		tc.t.Fatalf("%s: server did not read %q", tc.name, frame)
+	}
+}
+
+// leave closes the connection from the client's side, like closing a tab
+func (tc *testClient) leave() {
+	close(tc.fake.in)
+}
+
+// next returns the next frame the server wrote to the client
+func (tc *testClient) next() *envelope {
+	tc.t.Helper()
+	select {
+	case msg := <-tc.fake.out:
+		var e envelope
+		if err := json.Unmarshal(msg, &e); err != nil {
+			tc.t.Fatalf("%s: bad frame %s: %v", tc.name, msg, err)
+		}
+		return &e
+	case <-time.After(testTimeout):
+		tc.t.Fatalf("%s: no frame within %v", tc.name, testTimeout)
+		return nil
+	}
+}
+
+// expect skips frames until one of type typ, failing the test if none comes
+func (tc *testClient) expect(typ string) *envelope {
+	tc.t.Helper()
+	for {
+		if e := tc.next(); e.Type == typ {
+			return e
+		}
+	}
+}
+
+// expectSystem skips frames until a system message containing text
+func (tc *testClient) expectSystem(text string) *envelope {
+	tc.t.Helper()
+	for {
+		if e := tc.expect("system"); strings.Contains(e.Message, text) {
+			return e
+		}
+	}
+}
+
+func TestBroadcastJoinAndLeave(t *testing.T) {
+	r := newTestRoom(t, "harness")
+	alice := joinTestRoom(t, r, "alice")
+	bob := joinTestRoom(t, r, "bob")
+	alice.expectSystem("bob")
+
+	alice.send("hello")
+	for _, c := range []*testClient{alice, bob} {
+		e := c.expect("message")
+		if e.Name != "alice" || e.Message != "hello" || e.Seq != 1 {
+			t.Errorf("%s got %+v, want hello from alice as seq 1", c.name, e)
+		}
+	}
+
+	alice.leave()
+	bob.expectSystem("alice")
+	select {
+	case <-alice.done:
+	case <-time.After(testTimeout):
+		t.Fatal("write() of a client that left did not exit")
+	}
+}
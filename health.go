@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// when the server started, for the health check's uptime
+var started = time.Now()
+
+// healthStatus is the body of /health when JSON is asked for
+type healthStatus struct {
+	Status  string `json:"status"`
+	Rooms   int    `json:"rooms"`
+	Clients int64  `json:"clients"`
+
+	// seconds since the server started
+	Uptime int64 `json:"uptime"`
+}
+
+// healthHandler answers plain "OK" for simple load balancer probes, or a
+// JSON status with ?format=json or an Accept: application/json header
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") != "json" && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+		return
+	}
+
+	mu.Lock()
+	n := len(rooms)
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(healthStatus{
+		Status:  "ok",
+		Rooms:   n,
+		Clients: connections.Load(),
+		Uptime:  int64(time.Since(started) / time.Second),
+	})
+}
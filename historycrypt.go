@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// sealedLine is how an encrypted message is kept in a history file, the
+// whole JSON message sealed with AES-GCM under the key with the given id.
+// Sealed comes first so readHistory can tell these lines apart cheaply.
+type sealedLine struct {
+	Sealed []byte `json:"sealed"`
+	Key    string `json:"key"`
+}
+
+var sealedPrefix = []byte(`{"sealed":`)
+
+// historyKeys encrypts history with HISTORY_ENCRYPTION_KEY and decrypts it
+// with that key or any of HISTORY_ENCRYPTION_OLD_KEYS
+type historyKeys struct {
+	// nil when only old keys are given, history is then read but not sealed
+	current   cipher.AEAD
+	currentID string
+	byID      map[string]cipher.AEAD
+}
+
+// newHistoryKeys parses base64 AES keys of 16, 24 or 32 bytes; current may
+// be empty to stop encrypting while old history stays readable
+func newHistoryKeys(current string, old []string) (*historyKeys, error) {
+	k := &historyKeys{byID: make(map[string]cipher.AEAD)}
+	for i, key := range append([]string{current}, old...) {
+		if i == 0 && key == "" {
+			continue
+		}
+		aead, id, err := parseHistoryKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.current, k.currentID = aead, id
+		}
+		k.byID[id] = aead
+	}
+	return k, nil
+}
+
+// parseHistoryKey returns the cipher of a key and its id, the start of
+// the key's SHA-256 so files name the key without giving it away
+func parseHistoryKey(key string) (cipher.AEAD, string, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("key is not base64: %w", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("key must be 16, 24 or 32 bytes: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(raw)
+	return aead, hex.EncodeToString(sum[:4]), nil
+}
+
+// seal encrypts a JSON message into a sealedLine, with a random nonce
+// prepended to the ciphertext
+func (k *historyKeys) seal(line []byte) ([]byte, error) {
+	nonce := make([]byte, k.current.NonceSize(), k.current.NonceSize()+len(line)+k.current.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedLine{
+		Sealed: k.current.Seal(nonce, nonce, line, nil),
+		Key:    k.currentID,
+	})
+}
+
+var errUnknownHistoryKey = errors.New("sealed with a key that is not configured")
+
+// open returns the JSON message of a history line, decrypting it when it
+// is sealed; k may be nil, and plain lines pass through either way
+func (k *historyKeys) open(line []byte) ([]byte, error) {
+	if !bytes.HasPrefix(line, sealedPrefix) {
+		return line, nil
+	}
+	var sealed sealedLine
+	if err := json.Unmarshal(line, &sealed); err != nil {
+		return nil, err
+	}
+	var aead cipher.AEAD
+	if k != nil {
+		aead = k.byID[sealed.Key]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("key %s: %w", sealed.Key, errUnknownHistoryKey)
+	}
+	if len(sealed.Sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed message too short")
+	}
+	nonce, ciphertext := sealed.Sealed[:aead.NonceSize()], sealed.Sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// kinds of room events passed to hooks
+const (
+	eventRoomCreated = "room_created"
+	eventRoomClosed  = "room_closed"
+	eventRoomRenamed = "room_renamed"
+	eventJoin        = "join"
+	eventLeave       = "leave"
+	eventMessage     = "message"
+)
+
+// hookQueueSize bounds the events waiting for hooks, more are dropped
+const hookQueueSize = 1024
+
+// roomEvent is something that happened in a room
+type roomEvent struct {
+	kind string
+	room string
+	time time.Time
+
+	// the client that joined, left or sent the message, empty for room events
+	client string
+
+	// a copy of the chat message for eventMessage
+	message *envelope
+
+	// the room's previous name for eventRoomRenamed
+	previous string
+
+	// why the client left for eventLeave: one of the left* reasons when it
+	// went on its own, or the reason it was disconnected with like "archived"
+	reason string
+}
+
+// hook observes room events without being part of the room's loop, e.g.
+// for auditing or metrics. Hooks run on a single dispatcher goroutine.
+type hook interface {
+	handleEvent(ev roomEvent)
+}
+
+var (
+	hooks         []hook
+	hookEvents    chan roomEvent
+	droppedEvents = expvar.NewInt("hook_events_dropped")
+)
+
+// registerHook adds a hook, only call it at startup before startHooks
+func registerHook(h hook) {
+	hooks = append(hooks, h)
+}
+
+// startHooks runs the dispatcher if any hooks are registered
+func startHooks() {
+	if len(hooks) == 0 {
+		return
+	}
+	hookEvents = make(chan roomEvent, hookQueueSize)
+	go func() {
+		for ev := range hookEvents {
+			for _, h := range hooks {
+				callHook(h, ev)
+			}
+		}
+	}()
+}
+
+// callHook runs one hook, a panicking hook doesn't stop the others
+func callHook(h hook, ev roomEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("panic in hook for %s event in room %q: %v\n%s", ev.kind, ev.room, err, debug.Stack())
+		}
+	}()
+	h.handleEvent(ev)
+}
+
+// emit queues an event for the hooks without ever blocking the caller, a
+// full queue drops the event
+func emit(ev roomEvent) {
+	if hookEvents == nil {
+		return
+	}
+	ev.time = time.Now()
+	select {
+	case hookEvents <- ev:
+	default:
+		droppedEvents.Add(1)
+	}
+}
+
+// auditHook logs joins, leaves and room creation, not message contents
+type auditHook struct{}
+
+func (auditHook) handleEvent(ev roomEvent) {
+	switch ev.kind {
+	case eventRoomCreated:
+		log.Printf("audit: room %q created", ev.room)
+	case eventRoomClosed:
+		log.Printf("audit: room %q closed", ev.room)
+	case eventRoomRenamed:
+		log.Printf("audit: room %q renamed to %q", ev.previous, ev.room)
+	case eventJoin:
+		joinLog.printf(ev.room, "audit: %s joined room %q", ev.client, ev.room)
+	case eventLeave:
+		leaveLog.printf(ev.room, "audit: %s left room %q (%s)", ev.client, ev.room, ev.reason)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultLang is used for clients without ?lang= and for keys missing from a catalog
+const defaultLang = "en"
+
+// catalogs maps a language to its system message formats by key,
+// formats use fmt verbs for their arguments
+var catalogs = map[string]map[string]string{
+	"en": {
+		"joined":                "%s joined the room",
+		"left":                  "%s left the room",
+		"left_going_away":       "%s closed the chat",
+		"left_connection_lost":  "%s lost their connection",
+		"left_error":            "%s disconnected after an error",
+		"unknown_command":       "Unknown command %s",
+		"moderators_only":       "Only moderators can do that",
+		"command_disabled":      "%s is not available in this room",
+		"commands_enabled":      "Commands available in this room: %s",
+		"type_not_allowed":      "This room doesn't accept %q frames",
+		"type_moderators_only":  "Only moderators can send %q frames in this room",
+		"types_set":             "Who can send what in this room: %s",
+		"types_usage":           "Usage: /types all or /types <type>=<all|moderators|none>..., types are %s",
+		"format_usage":          "Usage: /%s <text>",
+		"shout_too_long":        "Shouts can be at most %d characters",
+		"server_restarting":     "The server is restarting, please reconnect to keep chatting",
+		"room_renamed":          "This room is now called %s",
+		"closing_archived":      "This room was archived after a long time without activity, rejoin to continue",
+		"closing_shutdown":      "The server is restarting, please reconnect in a moment",
+		"nick_usage":            "Usage: /nick <name>, up to %d letters, digits, '-', '_' or '.'",
+		"nick_cooldown":         "You can change your name again in %v",
+		"nick_taken":            "Someone called %s is already in this room",
+		"renamed":               "%s is now known as %s",
+		"setpass_usage":         "Usage: /setpass <password>, %d to %d characters",
+		"setpass_cooldown":      "The room password can be changed again in %v",
+		"password_changed":      "%s changed the room password, new members need the new one to join",
+		"invalid_password":      "This room needs a password, and the one sent doesn't match",
+		"forward_protected":     "%s is protected by a password, only moderators can forward to it",
+		"forward_paused":        "%s is paused, only moderators can forward to it",
+		"forward_origin":        "%s doesn't accept clients from this site",
+		"forward_bad_room":      "%q is not a valid room name",
+		"forward_limited":       "You created too many rooms, try again in %v",
+		"motd_too_long":         "The message of the day can be at most %d characters",
+		"motd_set":              "Message of the day set, joining members will see it",
+		"motd_cleared":          "Message of the day cleared",
+		"paused":                "%s paused the room, only moderators can post until it is resumed",
+		"resumed":               "%s resumed the room",
+		"room_paused":           "The room is paused for maintenance, your message was not sent",
+		"history_usage":         "Usage: /history <n>, n from 0 to %d",
+		"history_truncated":     "%d older messages were left out to keep the history short",
+		"history_set":           "This room now keeps its last %d messages",
+		"bot_rate_limited":      "Bots are sending too fast, your message was not sent",
+		"message_too_long":      "Messages can be at most %d characters, yours was not sent",
+		"message_truncated":     "Messages can be at most %d characters, yours was shortened",
+		"too_many_blank_lines":  "Messages can have at most %d blank lines in a row, yours was not sent",
+		"message_not_found":     "Message %d is not in this room's history",
+		"room_not_found":        "Room %q does not exist",
+		"forward_usage":         "Usage: /forward <seq> <room>",
+		"forwarded":             "Forwarded message %d to %s",
+		"delete_usage":          "Usage: /delete <seq>",
+		"delete_not_author":     "You can only delete your own messages",
+		"edit_not_author":       "You can only edit your own messages",
+		"edit_window":           "Messages can only be edited within %v of sending",
+		"edit_empty":            "Use /delete to remove a message",
+		"poll_usage":            `Usage: /poll "Question?" "option 1" "option 2"`,
+		"poll_too_many_options": "A poll can have at most %d options",
+		"poll_question_length":  "The poll question must be 1-%d characters",
+		"poll_option_length":    "Poll options must be 1-%d characters",
+		"poll_not_found":        "No such poll",
+		"poll_closed":           "This poll is closed",
+		"poll_invalid_option":   "Invalid poll option",
+		"closepoll_usage":       "Usage: /closepoll <id>",
+		"closepoll_not_owner":   "Only the creator of a poll can close it",
+		"schedule_empty":        "Cannot schedule an empty message",
+		"schedule_command":      "Commands cannot be scheduled",
+		"schedule_past":         "Scheduled time must be in the future",
+		"schedule_too_far":      "Messages can be scheduled at most %v ahead",
+		"schedule_limit":        "You already have %d scheduled messages",
+		"schedule_room_limit":   "This room already has %d scheduled messages",
+		"schedule_not_found":    "No such scheduled message",
+	},
+	// partial translation, missing keys fall back to English
+	"es": {
+		"joined":          "%s se unió a la sala",
+		"left":            "%s salió de la sala",
+		"unknown_command": "Comando desconocido %s",
+		"room_not_found":  "La sala %q no existe",
+		"poll_not_found":  "No existe esa encuesta",
+		"poll_closed":     "Esta encuesta está cerrada",
+	},
+}
+
+// loadCatalogs merges <lang>.json files from dir over the built-in catalogs,
+// each file is a JSON object of key to format
+func loadCatalogs(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if catalogs[lang] == nil {
+			catalogs[lang] = make(map[string]string)
+		}
+		for key, format := range messages {
+			catalogs[lang][key] = format
+		}
+	}
+	return nil
+}
+
+// parseLang picks the best available catalog for a ?lang= value like "es-MX"
+func parseLang(lang string) string {
+	lang = strings.ToLower(strings.ReplaceAll(lang, "_", "-"))
+	if _, ok := catalogs[lang]; ok {
+		return lang
+	}
+	if base, _, found := strings.Cut(lang, "-"); found {
+		if _, ok := catalogs[base]; ok {
+			return base
+		}
+	}
+	return defaultLang
+}
+
+// translate renders the system message key in lang
+func translate(lang, key string, args ...any) string {
+	format, ok := catalogs[lang][key]
+	if !ok {
+		if format, ok = catalogs[defaultLang][key]; !ok {
+			format = key
+		}
+	}
+	return fmt.Sprintf(format, args...)
+}
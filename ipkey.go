@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the IP address of the user that sent the request. The
+// forwarding headers are only believed when the peer is a trusted proxy,
+// otherwise anyone could claim any address.
+func clientIP(r *http.Request) string {
+	peer := clientPeer(r)
+	if !containsIP(cfg.trustedProxies, peer) {
+		return peer
+	}
+
+	// each proxy appends the address it received the request from, so walk
+	// back from the end until an address that isn't one of our proxies
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		ip := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !containsIP(cfg.trustedProxies, hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return peer
+}
+
+// clientPeer returns the IP address of the immediate peer, which may be a proxy
+func clientPeer(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return peer
+}
+
+// ipKey turns an IP address into an opaque identifier using an HMAC keyed
+// with the server secret. Per-IP limits and bans use this key so raw
+// addresses never need to be kept in memory or written to logs.
+func ipKey(ip string) string {
+	mac := hmac.New(sha256.New, cfg.ipHashSecret)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
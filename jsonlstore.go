@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// longest line read back from a history file, well above MAX_MESSAGE_BYTES
+// so rendered HTML and link previews fit too
+const maxHistoryLine = 1 << 20
+
+// jsonlStore keeps each room's history as one JSON message per line in
+// <dir>/<room>.jsonl. A file that grows past maxBytes is renamed to
+// <room>.1.jsonl, replacing the previous one, and a new file is started.
+// Room configuration is kept in <dir>/rooms.json.
+type jsonlStore struct {
+	dir      string
+	maxBytes int64
+
+	// with keys, messages of encryptRooms (or of every room when it is
+	// empty) are written as sealed lines, see historycrypt.go
+	keys         *historyKeys
+	encryptRooms []string
+
+	// Save runs on the store writer, Recent and Polls on room creation,
+	// Recent also on stats
+	mu sync.Mutex
+}
+
+func newJSONLStore(dir string, maxBytes int64) (*jsonlStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &jsonlStore{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// path returns the history file of room, or of its rotated predecessor;
+// room names are escaped as they come straight from ?room=
+func (s *jsonlStore) path(room string, rotated bool) string {
+	name := url.PathEscape(room)
+	if rotated {
+		name += ".1"
+	}
+	return filepath.Join(s.dir, name+".jsonl")
+}
+
+// historyRecord is a line of a history file: a chat message with its
+// author, or an "edit" or "delete" of the earlier message with its Seq. A
+// poll is a "poll" line with its creator as author, a "vote" line for each
+// vote with the voter as author, and a "closepoll" line once it closes.
+type historyRecord struct {
+	*envelope
+	Author string `json:"author,omitempty"`
+}
+
+func (s *jsonlStore) Save(batch []storedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines := make(map[string][]byte)
+	var order []string
+	for _, m := range batch {
+		line, err := json.Marshal(historyRecord{envelope: m.e, Author: m.e.author})
+		if err != nil {
+			return err
+		}
+		if s.encrypts(m.room) {
+			if line, err = s.keys.seal(line); err != nil {
+				return err
+			}
+		}
+		if _, ok := lines[m.room]; !ok {
+			order = append(order, m.room)
+		}
+		lines[m.room] = append(append(lines[m.room], line...), '\n')
+	}
+
+	for _, room := range order {
+		if err := s.append(room, lines[room]); err != nil {
+			return fmt.Errorf("room %q: %w", room, err)
+		}
+	}
+	return nil
+}
+
+// encrypts reports whether messages of room are written encrypted
+func (s *jsonlStore) encrypts(room string) bool {
+	if s.keys == nil || s.keys.current == nil {
+		return false
+	}
+	return len(s.encryptRooms) == 0 || slices.Contains(s.encryptRooms, room)
+}
+
+// append writes lines to room's file, rotating it first when it is full
+func (s *jsonlStore) append(room string, lines []byte) error {
+	path := s.path(room, false)
+	if s.maxBytes > 0 {
+		if info, err := os.Stat(path); err == nil && info.Size() >= s.maxBytes {
+			if err := os.Rename(path, s.path(room, true)); err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(lines); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Recent reads history files backwards from their end, so loading a room
+// costs its last n messages and not the whole file
+func (s *jsonlStore) Recent(room string, n int) ([]*envelope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var messages []*envelope // newest first
+	// edits and deletes follow their message, read backwards they are met
+	// first and held until it turns up; the newest change wins
+	changes := make(map[uint64]*envelope)
+	collect := func(rec historyRecord) bool {
+		e := rec.envelope
+		switch e.Type {
+		case "edit", "delete":
+			if _, ok := changes[e.Seq]; !ok {
+				changes[e.Seq] = e
+			}
+			return true
+		case "poll", "vote", "closepoll":
+			return true
+		}
+		e.author = rec.Author
+		if change, ok := changes[e.Seq]; ok {
+			applyChange(e, change)
+		}
+		messages = append(messages, e)
+		return len(messages) < n
+	}
+
+	if err := s.readRecent(room, collect); err != nil {
+		return nil, err
+	}
+	slices.Reverse(messages)
+	return messages, nil
+}
+
+// Polls reads history files backwards like Recent, up to the nth latest
+// message, and rebuilds the at most maxPolls newest polls found there
+func (s *jsonlStore) Polls(room string, n int) ([]*poll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var polls []*poll // newest first
+	// votes and closes follow their poll, read backwards they are met first;
+	// a voter's newest vote wins
+	votes := make(map[int]map[string]int)
+	closed := make(map[int]bool)
+	seen := make(map[int]bool)
+	messages := 0
+	collect := func(rec historyRecord) bool {
+		e := rec.envelope
+		switch e.Type {
+		case "edit", "delete":
+		case "vote":
+			if votes[e.PollID] == nil {
+				votes[e.PollID] = make(map[string]int)
+			}
+			if _, ok := votes[e.PollID][rec.Author]; !ok && e.Option != nil {
+				votes[e.PollID][rec.Author] = *e.Option
+			}
+		case "closepoll":
+			closed[e.PollID] = true
+		case "poll":
+			// ids start over when a room loses its polls, only the newest
+			// poll with an id counts
+			if !seen[e.PollID] {
+				seen[e.PollID] = true
+				polls = append(polls, restoredPoll(rec, votes[e.PollID], closed[e.PollID]))
+			}
+			delete(votes, e.PollID)
+			delete(closed, e.PollID)
+		default:
+			messages++
+		}
+		return messages < n && len(polls) < maxPolls
+	}
+
+	if err := s.readRecent(room, collect); err != nil {
+		return nil, err
+	}
+	slices.Reverse(polls)
+	return polls, nil
+}
+
+// restoredPoll builds a poll from its "poll" record and the votes found for it
+func restoredPoll(rec historyRecord, votes map[string]int, closed bool) *poll {
+	e := rec.envelope
+	p := &poll{
+		id:       e.PollID,
+		creator:  e.Name,
+		owner:    rec.Author,
+		question: e.Question,
+		options:  e.Options,
+		votes:    make(map[string]int),
+		closed:   closed,
+		created:  time.UnixMilli(e.Time),
+	}
+	for voter, option := range votes {
+		if option >= 0 && option < len(p.options) {
+			p.votes[voter] = option
+		}
+	}
+	return p
+}
+
+// readRecent calls collect with the records of room's history, newest
+// first, until it returns false; the rotated file is only read when the
+// current one runs out first
+func (s *jsonlStore) readRecent(room string, collect func(historyRecord) bool) error {
+	more := true
+	for _, rotated := range []bool{false, true} {
+		err := s.readHistory(s.path(room, rotated), func(rec historyRecord) bool {
+			more = collect(rec)
+			return more
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyChange applies a stored "edit" or "delete" to its message the way
+// the room did when it happened
+func applyChange(e, change *envelope) {
+	if change.Type == "delete" {
+		e.Deleted = true
+		e.Message = ""
+		e.HTML = ""
+		return
+	}
+	e.Message = change.Message
+	e.HTML = change.HTML
+	e.EditedAt = change.EditedAt
+}
+
+// readHistory calls collect with the records of a history file, newest
+// first, until it returns false; a missing file is empty and a torn last
+// line from a crash mid-write is skipped, as are records sealed with a key
+// that is no longer configured
+func (s *jsonlStore) readHistory(path string, collect func(historyRecord) bool) error {
+	var undecryptable int
+	err := readLinesBackwards(path, func(raw []byte) bool {
+		line, err := s.keys.open(raw)
+		if err != nil {
+			undecryptable++
+			return true
+		}
+		rec := historyRecord{envelope: &envelope{}}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return true
+		}
+		return collect(rec)
+	})
+	if undecryptable > 0 {
+		log.Printf("Skipped %d messages in %s that could not be decrypted, is their key in HISTORY_ENCRYPTION_OLD_KEYS?", undecryptable, path)
+	}
+	return err
+}
+
+// size of the blocks history files are read in, from their end
+const historyBlockSize = 64 << 10
+
+// readLinesBackwards calls f with each line of a file from the last to the
+// first until f returns false; f must not keep the line
+func readLinesBackwards(path string, f func(line []byte) bool) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// rest is the start of the file's remaining last line, which began
+	// somewhere before the block just read
+	var rest []byte
+	for end := info.Size(); end > 0; {
+		size := min(end, historyBlockSize)
+		end -= size
+		block := make([]byte, size, size+int64(len(rest)))
+		if _, err := file.ReadAt(block, end); err != nil {
+			return err
+		}
+		data := append(block, rest...)
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			if line := data[i+1:]; len(line) > 0 && !f(line) {
+				return nil
+			}
+			data = data[:i]
+		}
+		if len(data) > maxHistoryLine {
+			return bufio.ErrTooLong
+		}
+		rest = data
+	}
+	if len(rest) > 0 {
+		f(rest)
+	}
+	return nil
+}
+
+// RenameRoom moves the room's history files and its entry in rooms.json
+func (s *jsonlStore) RenameRoom(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rotated := range []bool{false, true} {
+		err := os.Rename(s.path(from, rotated), s.path(to, rotated))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	configs, err := s.rooms()
+	if err != nil {
+		return err
+	}
+	rc, ok := configs[from]
+	if !ok {
+		return nil
+	}
+	delete(configs, from)
+	rc.Name = to
+	configs[to] = rc
+	return s.writeRooms(configs)
+}
+
+func (s *jsonlStore) SaveRoom(rc roomConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	configs, err := s.rooms()
+	if err != nil {
+		return err
+	}
+	configs[rc.Name] = rc
+	return s.writeRooms(configs)
+}
+
+// writeRooms replaces rooms.json, called with mu held
+func (s *jsonlStore) writeRooms(configs map[string]roomConfig) error {
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write a temporary file and rename it so a crash never leaves half a file
+	path := filepath.Join(s.dir, "rooms.json")
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *jsonlStore) Rooms() ([]roomConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	configs, err := s.rooms()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]roomConfig, 0, len(configs))
+	for _, rc := range configs {
+		list = append(list, rc)
+	}
+	return list, nil
+}
+
+// rooms reads rooms.json as a map by room name, called with mu held
+func (s *jsonlStore) rooms() (map[string]roomConfig, error) {
+	configs := make(map[string]roomConfig)
+	data, err := os.ReadFile(filepath.Join(s.dir, "rooms.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return configs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
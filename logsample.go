@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// sampledLog logs a frequent event per room: the first LOG_SAMPLE_BURST of
+// each LOG_SUMMARY_INTERVAL in full, then one in LOG_SAMPLE_RATE, and a
+// count of everything at the end of the interval, so a reconnect storm
+// produces a summary instead of a line per connection
+type sampledLog struct {
+	kind string
+
+	mu sync.Mutex
+	// per room, events seen and lines logged in the current interval
+	seen   map[string]int
+	logged map[string]int
+}
+
+// events that are sampled, see startLogSummaries
+var (
+	joinLog    = newSampledLog("joins")
+	leaveLog   = newSampledLog("leaves")
+	upgradeLog = newSampledLog("upgrade problems")
+
+	connectionLog = newSampledLog("connections")
+
+	sampledLogs = []*sampledLog{joinLog, leaveLog, upgradeLog, connectionLog}
+)
+
+func newSampledLog(kind string) *sampledLog {
+	return &sampledLog{kind: kind, seen: make(map[string]int), logged: make(map[string]int)}
+}
+
+// printf logs an event in room unless it is sampled out
+func (s *sampledLog) printf(room, format string, args ...any) {
+	// without summaries the counts would never reset, so nothing is sampled
+	if cfg.logSummaryInterval <= 0 {
+		log.Printf(format, args...)
+		return
+	}
+
+	s.mu.Lock()
+	s.seen[room]++
+	n := s.seen[room] - cfg.logSampleBurst
+	keep := n <= 0 || (cfg.logSampleRate > 0 && n%cfg.logSampleRate == 0)
+	if keep {
+		s.logged[room]++
+	}
+	s.mu.Unlock()
+
+	if keep {
+		log.Printf(format, args...)
+	}
+}
+
+// summarize logs how many events were sampled out in each room, then starts
+// a new interval
+func (s *sampledLog) summarize(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for room, n := range s.seen {
+		if logged := s.logged[room]; n > logged {
+			log.Printf("%d %s in room %q in the last %v, %d of them logged", n, s.kind, room, interval, logged)
+		}
+	}
+	clear(s.seen)
+	clear(s.logged)
+}
+
+// startLogSummaries ends each sampling interval with its summaries
+func startLogSummaries() {
+	if cfg.logSummaryInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(cfg.logSummaryInterval) {
+			for _, s := range sampledLogs {
+				s.summarize(cfg.logSummaryInterval)
+			}
+		}
+	}()
+}
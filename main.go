@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
+	"html/template"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
-	"text/template"
+	"syscall"
 	"time"
+	_ "time/tzdata" // timezones for ?tz= even on hosts without a zoneinfo database
 
+	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 )
 
@@ -22,10 +31,27 @@ type templateHandler struct {
 // handling template for our server
 
 func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, ok := newPageData(r)
+	if !ok {
+		http.Error(w, "Invalid room name", http.StatusBadRequest)
+		return
+	}
+
+	// in development pick up template edits without a restart
+	if cfg.templateReload {
+		templ, err := template.ParseFiles(filepath.Join("templates", t.filename))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		templ.Execute(w, data)
+		return
+	}
+
 	t.once.Do(func() {
 		t.templ = template.Must(template.ParseFiles(filepath.Join("templates", t.filename)))
 	})
-	t.templ.Execute(w, r)
+	t.templ.Execute(w, data)
 }
 
 func main() {
@@ -35,6 +61,55 @@ func main() {
 	if err != nil {
 		log.Println("No .env file found, using environment variables from system")
 	}
+	cfg = loadConfig()
+	log.Printf("connection health: ping every %v, pong wait %v, write wait %v", cfg.pingInterval, cfg.pongWait, cfg.writeWait)
+	if err := loadNameLists(); err != nil {
+		log.Fatal("Loading name word lists: ", err)
+	}
+	if cfg.geoIPFile != "" {
+		if err := loadGeoIP(cfg.geoIPFile); err != nil {
+			log.Fatal("Loading GeoIP database: ", err)
+		}
+	}
+	if cfg.localeDir != "" {
+		if err := loadCatalogs(cfg.localeDir); err != nil {
+			log.Fatal("Loading message catalogs: ", err)
+		}
+	}
+	upgrader.ReadBufferSize = cfg.readBufferSize
+	upgrader.WriteBufferSize = cfg.writeBufferSize
+	if cfg.writeBufferPool {
+		upgrader.WriteBufferPool = &writeBufferPool
+	}
+	if cfg.upgradeRate > 0 {
+		upgradeLimiter = newRateLimiter(cfg.upgradeRate, cfg.upgradeBurst)
+	}
+	if cfg.roomCreateLimit > 0 && cfg.roomCreateWindow > 0 {
+		roomCreateLimiter = newRateLimiter(float64(cfg.roomCreateLimit)/cfg.roomCreateWindow.Seconds(), cfg.roomCreateLimit)
+	}
+	if cfg.botMessageRate > 0 {
+		botLimiter = newRateLimiter(cfg.botMessageRate, cfg.botMessageBurst)
+	}
+	storeBreaker = newCircuitBreaker("store", cfg.storeBreakerThreshold, cfg.storeBreakerCooldown)
+	if cfg.historyDir != "" {
+		s, err := newJSONLStore(cfg.historyDir, cfg.historyMaxBytes)
+		if err != nil {
+			log.Fatal("Opening history directory: ", err)
+		}
+		if cfg.historyKey != "" || len(cfg.historyOldKeys) > 0 {
+			if s.keys, err = newHistoryKeys(cfg.historyKey, cfg.historyOldKeys); err != nil {
+				log.Fatal("Invalid history encryption key: ", err)
+			}
+			s.encryptRooms = cfg.historyEncryptRooms
+		}
+		store = s
+	}
+	if cfg.historyKey != "" && store == nil {
+		log.Println("HISTORY_ENCRYPTION_KEY needs HISTORY_DIR, nothing is persisted to encrypt")
+	}
+	if cfg.roomArchiveAfter > 0 && store == nil {
+		log.Println("ROOM_ARCHIVE_AFTER needs HISTORY_DIR, rooms won't be archived")
+	}
 
 	// make every randomly generated number unique
 	rand.Seed(time.Now().UnixNano())
@@ -45,56 +120,201 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	addr := ":" + port
+	// HOST binds a single interface, e.g. 127.0.0.1 behind a local proxy;
+	// unset listens on all of them
+	addr := net.JoinHostPort(os.Getenv("HOST"), port)
+	if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+		log.Fatalf("invalid listen address %q: %v", addr, err)
+	}
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	http.Handle("/", &templateHandler{filename: "index.html"})
-	http.Handle("/chat", &templateHandler{filename: "chat.html"})
+	// routes live on their own mux: importing expvar registers a public
+	// /debug/vars on http.DefaultServeMux
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.Handle("/", &templateHandler{filename: "index.html"})
+	mux.Handle("/chat", &templateHandler{filename: "chat.html"})
+	mux.Handle("GET /chat/{room}", &templateHandler{filename: "chat.html"})
 
-	http.HandleFunc("/room", func(w http.ResponseWriter, r *http.Request) {
-		roomName := r.URL.Query().Get("room")
-		if roomName == "" {
-			http.Error(w, "Missing room parameter", http.StatusBadRequest)
-			return
-		}
-		realRoom := getRoom(roomName) // Get the room instance
-		realRoom.ServeHTTP(w, r)      // Call the ServeHTTP method on the room instance
-	})
+	mux.HandleFunc("/room", roomHandler)
+
+	// what this server is configured to do
+	mux.HandleFunc("GET /capabilities", capabilitiesHandler)
+
+	// open rooms with their creation time and uptime
+	mux.HandleFunc("GET /rooms", roomsHandler)
+
+	// message counts per user and hour, from the stored history
+	mux.HandleFunc("GET /rooms/{name}/stats", statsHandler)
+
+	// read-only stream of every room matching ?rooms=, for operators
+	mux.HandleFunc("/monitor", monitorHandler)
+
+	// the caller's own connection, identified by its session token
+	mux.HandleFunc("GET /rooms/{name}/me", meHandler)
+
+	// everyone in a room with their connection stats, needs ADMIN_TOKEN
+	mux.HandleFunc("GET /rooms/{name}/users", usersHandler)
+
+	// single message permalinks
+	mux.HandleFunc("GET /rooms/{name}/messages/{seq}", messageHandler)
+
+	// Slack-compatible incoming webhooks, into rooms with a HOOK_TOKENS token
+	mux.HandleFunc("POST /hooks/{room}", hookHandler)
+	mux.HandleFunc("POST /hooks/{room}/{token}", hookHandler)
 
 	// Health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	mux.HandleFunc("/health", healthHandler)
 
-	//start the web server
+	// move a room and its history to a new name, needs ADMIN_TOKEN
+	mux.HandleFunc("PUT /rooms/{name}", renameRoomHandler)
+
+	// goroutine, memory and GC stats for spotting leaks, needs ADMIN_TOKEN
+	mux.HandleFunc("GET /debug/runtime", runtimeHandler)
+
+	// connections by country, browser and origin, needs ADMIN_TOKEN
+	mux.HandleFunc("GET /debug/audience", audienceHandler)
 
-	log.Println("starting web server on", addr)
+	// expvar counters, needs ADMIN_TOKEN
+	mux.HandleFunc("GET /debug/vars", varsHandler)
 
-	if err := http.ListenAndServe(addr, CORSMiddleware(http.DefaultServeMux)); err != nil {
-		log.Fatal("ListenAndServe:", err)
+	// readiness for load balancers, 503 once shutdown has begun
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	if store != nil {
+		startStoreWriter()
+	}
+	if cfg.auditLog {
+		registerHook(auditHook{})
 	}
+	startHooks()
+	startLogSummaries()
+
+	// rooms configured by moderators outlive restarts, clients reconnect to them
+	if err := restoreRooms(); err != nil {
+		log.Fatal("Restoring rooms: ", err)
+	}
+
+	//start the web server
 
+	var handler http.Handler = withTimeouts(CORSMiddleware(mux))
+	if cfg.basePath != "" {
+		handler = withBasePath(cfg.basePath, handler)
+	}
+	// whole-request timeouts are set per request by withTimeouts, a server
+	// wide WriteTimeout would also cut off WebSocket upgrades
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.httpReadHeaderTimeout,
+		IdleTimeout:       cfg.httpIdleTimeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Println("starting web server on", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe:", err)
+		}
+	}()
+
+	// wait for a termination signal, then drain or stop per SHUTDOWN_MODE
+	<-ctx.Done()
+	log.Println("shutting down")
+	shutdown(server)
 }
 
+// methods offered in CORS preflights when the router has a route for them
+var corsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
 // CORSMiddleware adds the necessary headers to handle Cross-Origin Resource Sharing.
 // This is useful if you ever decide to host your frontend on a different domain.
-func CORSMiddleware(next http.Handler) http.Handler {
+func CORSMiddleware(mux *http.ServeMux) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set headers to allow cross-origin requests
 		// Note: Using "*" for Access-Control-Allow-Origin is permissive.
 		// For production, you should restrict this to your frontend's domain.
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", cfg.corsAllowedHeaders)
 
-		// If this is a preflight request (OPTIONS), we can just send an OK status.
+		// Answer OPTIONS ourselves with the methods this path is routed for,
+		// rejecting preflights for any other method.
 		if r.Method == "OPTIONS" {
+			methods := allowedMethods(mux, r)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+			requested := r.Header.Get("Access-Control-Request-Method")
+			if requested != "" && !slices.Contains(methods, requested) {
+				w.Header().Set("Allow", strings.Join(methods, ", "))
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			// let browsers cache the preflight instead of repeating it for every request
+			if cfg.corsMaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.corsMaxAge.Seconds())))
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
 		// Otherwise, serve the request to the next handler.
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowedMethods asks the router which methods it serves for the request's
+// path, limited to CORS_ALLOWED_METHODS when that is set
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var methods []string
+	for _, method := range corsMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		// "/" catches every path the other routes don't, it doesn't count as
+		// routing the method for them
+		_, pattern := mux.Handler(probe)
+		if pattern == "" || pattern == "/" && r.URL.Path != "/" {
+			continue
+		}
+		if len(cfg.corsAllowedMethods) > 0 && !slices.Contains(cfg.corsAllowedMethods, method) {
+			continue
+		}
+		methods = append(methods, method)
+	}
+	return append(methods, "OPTIONS")
+}
+
+// withBasePath serves next under prefix as if it were mounted at the root,
+// redirecting the bare prefix to its index page and refusing other paths
+func withBasePath(prefix string, next http.Handler) http.Handler {
+	stripped := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == prefix:
+			http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, prefix+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// withTimeouts bounds how long reading a request and writing its response
+// may take, except for WebSocket upgrades: those connections live on after
+// the handshake and get their deadlines from the ping/pong keepalive
+func withTimeouts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			rc := http.NewResponseController(w)
+			if cfg.httpReadTimeout > 0 {
+				rc.SetReadDeadline(time.Now().Add(cfg.httpReadTimeout))
+			}
+			if cfg.httpWriteTimeout > 0 {
+				rc.SetWriteDeadline(time.Now().Add(cfg.httpWriteTimeout))
+			}
+		}
 		next.ServeHTTP(w, r)
 	})
 }
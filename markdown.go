@@ -0,0 +1,73 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdCode   = regexp.MustCompile("`([^`\n]+)`")
+	mdLink   = regexp.MustCompile(`\[([^\]\n]+)\]\(([^()\s]+)\)`)
+	mdBold   = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	mdItalic = regexp.MustCompile(`\*([^*\n]+)\*|\b_([^_\n]+)_\b`)
+)
+
+// renderMarkdown turns the supported subset of Markdown (**bold**, *italic*,
+// `code` and [links](https://...)) into HTML. All of the text is escaped and
+// the only markup in the result is the fixed tags added here, so nothing a
+// user writes can inject HTML. Links are limited to http, https and mailto.
+func renderMarkdown(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range mdCode.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(renderLinks(text[last:m[0]]))
+		b.WriteString("<code>" + html.EscapeString(text[m[2]:m[3]]) + "</code>")
+		last = m[1]
+	}
+	b.WriteString(renderLinks(text[last:]))
+	return strings.ReplaceAll(b.String(), "\n", "<br>")
+}
+
+// renderLinks renders the links in a piece of text outside code spans
+func renderLinks(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range mdLink.FindAllStringSubmatchIndex(text, -1) {
+		href := text[m[4]:m[5]]
+		if !safeLink(href) {
+			continue
+		}
+		b.WriteString(renderEmphasis(text[last:m[0]]))
+		b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener noreferrer" target="_blank">`)
+		b.WriteString(renderEmphasis(text[m[2]:m[3]]))
+		b.WriteString("</a>")
+		last = m[1]
+	}
+	b.WriteString(renderEmphasis(text[last:]))
+	return b.String()
+}
+
+// renderEmphasis escapes text and then adds bold and italic tags, the
+// markers survive escaping untouched
+func renderEmphasis(text string) string {
+	s := html.EscapeString(text)
+	s = mdBold.ReplaceAllString(s, "<strong>$1</strong>")
+	return mdItalic.ReplaceAllString(s, "<em>$1$2</em>")
+}
+
+// safeLink reports whether href is an absolute link browsers won't execute
+func safeLink(href string) bool {
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
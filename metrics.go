@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync/atomic"
+)
+
+// metrics are published through expvar and served as JSON on /debug/vars
+// by varsHandler
+
+// connections is the number of open WebSocket connections across all rooms
+var connections atomic.Int64
+
+func init() {
+	expvar.Publish("connections", expvar.Func(func() any {
+		return map[string]int64{
+			"current": connections.Load(),
+			"max":     int64(cfg.maxConnections),
+		}
+	}))
+
+	// joins and leaves queued for the rooms' run() loops, see JOIN_QUEUE_SIZE
+	expvar.Publish("join_queue", expvar.Func(func() any {
+		mu.Lock()
+		defer mu.Unlock()
+		depth := map[string]int{"join": 0, "leave": 0, "max_room": 0}
+		for _, r := range rooms {
+			j, l := len(r.join), len(r.leave)
+			depth["join"] += j
+			depth["leave"] += l
+			depth["max_room"] = max(depth["max_room"], j+l)
+		}
+		return depth
+	}))
+}
+
+// varsHandler serves the expvar metrics on GET /debug/vars behind
+// ADMIN_TOKEN like /debug/runtime; they include the command line and full
+// memory stats
+func varsHandler(w http.ResponseWriter, req *http.Request) {
+	if cfg.adminToken == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	expvar.Handler().ServeHTTP(w, req)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// monitor streams the traffic of every room whose name matches pattern to
+// a single read-only socket, e.g. a dashboard watching "support-*"
+type monitor struct {
+	pattern string
+
+	// frames of all matching rooms, tagged with the room they came from
+	out chan []byte
+
+	// closed once the monitor has disconnected
+	done      chan struct{}
+	closeOnce sync.Once
+
+	socket *websocket.Conn
+	ip     string
+}
+
+// monitorFrame wraps a room's message for a monitor
+type monitorFrame struct {
+	Room  string          `json:"room"`
+	Event json.RawMessage `json:"event"`
+}
+
+// monitors currently connected, guarded by mu together with rooms
+var monitors = make(map[*monitor]bool)
+
+// isAdmin reports whether the request carries ADMIN_TOKEN, either as a
+// bearer token or as ?token= for clients that can't set headers
+func isAdmin(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+	return cfg.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.adminToken)) == 1
+}
+
+// matches reports whether the monitor watches the named room
+func (m *monitor) matches(name string) bool {
+	ok, _ := path.Match(m.pattern, name)
+	return ok
+}
+
+// attach registers a hidden pseudo-client on r that relays its traffic to
+// the monitor until it disconnects, called with mu held
+func (m *monitor) attach(r *room) {
+	c := &client{
+		transport: newWSTransport(m.socket),
+		room:      r,
+		receive:   make(chan []byte, sendQueueSize(m.socket.Subprotocol(), false, true)),
+		done:      make(chan struct{}),
+		name:      "monitor",
+		monitor:   true,
+		version:   wireV2,
+		ip:        m.ip,
+	}
+
+	// frames keep the name the room had when the monitor attached, the
+	// room's own name may only be read under mu or by its loop
+	name := r.name
+
+	// joining and leaving from one goroutine keeps them in order
+	go func() {
+		if !r.enter(c) {
+			return
+		}
+		go m.relay(name, c)
+		<-m.done
+		r.exit(c)
+	}()
+}
+
+// relay copies a pseudo-client's frames to the monitor, dropping them while
+// the monitor is behind, and keeps draining after the monitor is gone so
+// the room never blocks on it
+func (m *monitor) relay(room string, c *client) {
+	defer close(c.done)
+	for msg := range c.receive {
+		frame, err := json.Marshal(monitorFrame{Room: room, Event: msg})
+		if err != nil {
+			log.Println("Encoding failed:", err)
+			continue
+		}
+		select {
+		case m.out <- frame:
+		default:
+			droppedMonitor.Add(1)
+		}
+	}
+}
+
+// close detaches the monitor from every room
+func (m *monitor) close() {
+	m.closeOnce.Do(func() {
+		mu.Lock()
+		delete(monitors, m)
+		mu.Unlock()
+		close(m.done)
+	})
+}
+
+// monitorHandler serves /monitor?rooms=<pattern>, a read-only WebSocket
+// streaming every matching room, including rooms created later
+func monitorHandler(w http.ResponseWriter, req *http.Request) {
+	if cfg.adminToken == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	pattern := req.URL.Query().Get("rooms")
+	if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+		http.Error(w, "Invalid rooms pattern", http.StatusBadRequest)
+		return
+	}
+
+	// a monitor holds a connection like any client
+	if n := connections.Add(1); cfg.maxConnections > 0 && n > int64(cfg.maxConnections) {
+		connections.Add(-1)
+		w.Header().Set("Retry-After", capacityRetryAfter)
+		http.Error(w, "Server is at capacity", http.StatusServiceUnavailable)
+		return
+	}
+	defer connections.Add(-1)
+
+	socket, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return
+	}
+	defer socket.Close()
+
+	m := &monitor{
+		pattern: pattern,
+		out:     make(chan []byte, sendQueueSize(socket.Subprotocol(), false, true)),
+		done:    make(chan struct{}),
+		socket:  socket,
+		ip:      ipKey(clientIP(req)),
+	}
+	defer m.close()
+
+	mu.Lock()
+	monitors[m] = true
+	for name, r := range rooms {
+		if m.matches(name) {
+			m.attach(r)
+		}
+	}
+	mu.Unlock()
+
+	// anything the monitor sends is ignored, reading only notices it leaving
+	// or no longer answering pings
+	socket.SetReadDeadline(time.Now().Add(cfg.pongWait))
+	socket.SetPongHandler(func(string) error {
+		return socket.SetReadDeadline(time.Now().Add(cfg.pongWait))
+	})
+	go func() {
+		defer m.close()
+		for {
+			if _, _, err := socket.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(cfg.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-m.out:
+			socket.SetWriteDeadline(time.Now().Add(cfg.writeWait))
+			if err := socket.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(cfg.writeWait)); err != nil {
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// built-in word lists for generated names like "swift-otter"
+var (
+	defaultAdjectives = []string{
+		"brave", "bright", "calm", "clever", "cosmic", "curious", "daring", "eager",
+		"fancy", "fluffy", "gentle", "giddy", "golden", "happy", "humble", "jolly",
+		"kind", "lively", "lucky", "merry", "mighty", "misty", "nimble", "noble",
+		"plucky", "polite", "proud", "quick", "quiet", "rapid", "shiny", "silly",
+		"sleepy", "sly", "sneaky", "snowy", "sunny", "swift", "witty", "zesty",
+	}
+	defaultNouns = []string{
+		"badger", "beaver", "bison", "cheetah", "cobra", "coyote", "crane", "dingo",
+		"dolphin", "eagle", "falcon", "ferret", "gecko", "heron", "ibis", "jaguar",
+		"koala", "lemur", "lynx", "marmot", "meerkat", "moose", "narwhal", "ocelot",
+		"otter", "owl", "panda", "panther", "parrot", "pelican", "penguin", "puffin",
+		"quokka", "raven", "salmon", "sloth", "tapir", "tiger", "walrus", "wombat",
+	}
+)
+
+// palette for name colors, readable on a light background
+var nameColors = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#008080",
+	"#f032e6", "#9a6324", "#800000", "#808000", "#000075", "#46a0a0",
+}
+
+// nameColor picks a color for name, the same name always gets the same color
+func nameColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return nameColors[h.Sum32()%uint32(len(nameColors))]
+}
+
+// word lists in use, replaced at startup by NAME_ADJECTIVES_FILE and NAME_NOUNS_FILE
+var nameAdjectives, nameNouns = defaultAdjectives, defaultNouns
+
+// loadNameLists applies the configured word list files, keeping the built-in
+// lists for any that aren't set
+func loadNameLists() error {
+	var err error
+	if cfg.nameAdjectivesFile != "" {
+		if nameAdjectives, err = readWordList(cfg.nameAdjectivesFile); err != nil {
+			return err
+		}
+	}
+	if cfg.nameNounsFile != "" {
+		if nameNouns, err = readWordList(cfg.nameNounsFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readWordList reads one word per line, ignoring blank lines and # comments
+func readWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("word list %s is empty", path)
+	}
+	return words, nil
+}
+
+// randomName generates a name for a client that didn't choose one
+func randomName() string {
+	return nameAdjectives[rand.Intn(len(nameAdjectives))] + "-" + nameNouns[rand.Intn(len(nameNouns))]
+}
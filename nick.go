@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// longest name /nick accepts, in characters
+const maxNameLen = 32
+
+// nickCommand handles /nick <name>, renaming the client at most once per
+// NICK_COOLDOWN so renames can't be used to spam the room
+func (r *room) nickCommand(c *client, args []string) {
+	if len(args) != 1 {
+		r.reject(c, errInvalidCommand, "nick_usage", maxNameLen)
+		return
+	}
+	name := args[0]
+	if !validName(name) {
+		r.reject(c, errInvalidCommand, "nick_usage", maxNameLen)
+		return
+	}
+	if name == c.name {
+		return
+	}
+	if wait := cfg.nickCooldown - time.Since(c.renamed); !c.renamed.IsZero() && wait > 0 {
+		r.reject(c, errRateLimited, "nick_cooldown", wait.Round(time.Second))
+		return
+	}
+	if r.nameTaken(name, c) {
+		r.reject(c, errNameTaken, "nick_taken", name)
+		return
+	}
+
+	old := c.name
+	// a chosen name replaces the one the client was waiting to reclaim
+	c.wanted = ""
+	c.renamed = time.Now()
+	r.rename(c, name)
+	r.reclaimName(old)
+}
+
+// rename changes a client's name, announcing it and telling clients that
+// track the room's members which name it replaces
+func (r *room) rename(c *client, name string) {
+	old := c.name
+	c.setName(name)
+	r.announce("renamed", old, name)
+	r.broadcast(&envelope{Type: "rename", Name: name, Previous: old, Status: c.status, Bot: c.bot, Avatar: c.avatar})
+}
+
+// setName changes c's name along with the color and identicon derived from it
+func (c *client) setName(name string) {
+	// identicons follow the name, gravatars follow the email
+	if c.avatar != "" && c.avatar == identiconURL(c.name) {
+		c.avatar = identiconURL(name)
+	}
+	c.name = name
+	c.color = nameColor(name)
+}
+
+// nameTaken reports whether someone other than c is in the room as name
+func (r *room) nameTaken(name string, c *client) bool {
+	for other := range r.clients {
+		if other != c && other.name == name && !other.monitor {
+			return true
+		}
+	}
+	return false
+}
+
+// nameFree reports whether c can join as name: nobody else is in the room as
+// name, and nobody keeps the identity c would get with it after moving on
+// to another name with /nick or NAME_RECLAIM
+func (r *room) nameFree(name string, c *client) bool {
+	if r.nameTaken(name, c) {
+		return false
+	}
+	identity := clientIdentity(c.ip, name)
+	for other := range r.clients {
+		if other != c && other.identity == identity {
+			return false
+		}
+	}
+	return true
+}
+
+// uniqueName gives a joining client whose name is taken the first free one
+// with a number appended, alice2, alice3 and so on, remembering the name it
+// asked for so it can reclaim it later
+func (r *room) uniqueName(c *client) {
+	if r.nameFree(c.name, c) {
+		return
+	}
+	base := []rune(c.name)
+	for n := 2; ; n++ {
+		suffix := strconv.Itoa(n)
+		name := string(base[:min(len(base), maxNameLen-len(suffix))]) + suffix
+		if r.nameFree(name, c) {
+			c.wanted = c.name
+			c.setName(name)
+			return
+		}
+	}
+}
+
+// reclaimName hands a name that just became free back to the client that
+// was suffixed for wanting it the longest, with NAME_RECLAIM
+func (r *room) reclaimName(name string) {
+	if !cfg.nameReclaim || r.nameTaken(name, nil) {
+		return
+	}
+	var claimant *client
+	for c := range r.clients {
+		if c.wanted == name && (claimant == nil || c.joined.Before(claimant.joined)) {
+			claimant = c
+		}
+	}
+	if claimant == nil {
+		return
+	}
+	claimant.wanted = ""
+	r.rename(claimant, name)
+}
+
+// clientName picks the name a connecting client starts with per NAME_MODE:
+// always generated, ?name= when valid and generated otherwise, or ?name=
+// only; false when a required name is missing or invalid
+func clientName(req *http.Request) (string, bool) {
+	name := req.URL.Query().Get("name")
+	switch cfg.nameMode {
+	case "named":
+		return name, validName(name)
+	case "mixed":
+		if validName(name) {
+			return name, true
+		}
+	}
+	return randomName(), true
+}
+
+// validName reports whether name can be chosen with /nick, "system" is
+// reserved for server messages
+func validName(name string) bool {
+	if name == "" || utf8.RuneCountInString(name) > maxNameLen || strings.EqualFold(name, "system") {
+		return false
+	}
+	for _, ch := range name {
+		if !unicode.IsLetter(ch) && !unicode.IsDigit(ch) && !strings.ContainsRune("-_.", ch) {
+			return false
+		}
+	}
+	return true
+}
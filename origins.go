@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// roomOrigins restricts the rooms matching a glob pattern to WebSocket
+// upgrades from the listed origins, e.g. a support widget embedded on the
+// company site
+type roomOrigins struct {
+	pattern string
+	origins []string
+}
+
+// parseRoomOrigins parses ROOM_ORIGINS, comma separated entries of a room
+// pattern, '=' and space separated origins:
+// "support-*=https://example.com https://www.example.com,widget=https://shop.example"
+func parseRoomOrigins(s string) ([]roomOrigins, error) {
+	var list []roomOrigins
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, origins, ok := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); !ok || pattern == "" || err != nil {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		ro := roomOrigins{pattern: pattern}
+		for _, origin := range strings.Fields(origins) {
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("invalid origin %q", origin)
+			}
+			ro.origins = append(ro.origins, strings.ToLower(u.Scheme+"://"+u.Host))
+		}
+		if len(ro.origins) == 0 {
+			return nil, fmt.Errorf("no origins for %q", pattern)
+		}
+		list = append(list, ro)
+	}
+	return list, nil
+}
+
+// checkOrigin is the upgrader's CheckOrigin: rooms listed in ROOM_ORIGINS
+// only accept their origins, every other room only its own site as
+// gorilla/websocket does by default
+func checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if allowed, listed := roomOriginAllowed(req.URL.Query().Get("room"), origin); listed {
+		return allowed
+	}
+
+	// non-browser clients send no Origin
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// roomOriginAllowed checks origin against the first ROOM_ORIGINS entry
+// matching room, listed is false when no entry does
+func roomOriginAllowed(room, origin string) (allowed, listed bool) {
+	for _, ro := range cfg.roomOrigins {
+		if ok, _ := path.Match(ro.pattern, room); !ok {
+			continue
+		}
+		for _, o := range ro.origins {
+			if strings.EqualFold(origin, o) {
+				return true, true
+			}
+		}
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// pageData is the view model templates are rendered with
+type pageData struct {
+	// room from /chat/{room} or ?room=, empty on other pages
+	Room string
+
+	// BASE_PATH, prepended to every link and asset URL
+	BasePath string
+
+	// where the page's script connects to, empty without a room. Built by
+	// newPageData, so it is marked safe for html/template's ws:// check
+	WebSocketURL template.URL
+
+	// server settings the frontend adapts to
+	Markdown        bool
+	Moderators      bool
+	MaxMessageRunes int
+}
+
+// newPageData builds the view model for a request, reporting false when the
+// room in the path is not a valid room name
+func newPageData(r *http.Request) (*pageData, bool) {
+	data := &pageData{
+		Room:            r.PathValue("room"),
+		BasePath:        cfg.basePath,
+		Markdown:        cfg.markdown,
+		Moderators:      cfg.moderatorKey != "",
+		MaxMessageRunes: cfg.maxMessageRunes,
+	}
+	if data.Room != "" && !validRoomName(data.Room) {
+		return nil, false
+	}
+	if data.Room == "" {
+		data.Room = r.URL.Query().Get("room")
+	}
+
+	if data.Room != "" {
+		query := url.Values{"room": {data.Room}}
+		// the page's script unpacks batched frames
+		if cfg.batchWindow > 0 {
+			query.Set("batch", "1")
+		}
+		u := url.URL{
+			Scheme:   "ws",
+			Host:     r.Host,
+			Path:     cfg.basePath + "/room",
+			RawQuery: query.Encode(),
+		}
+		if isHTTPS(r) {
+			u.Scheme = "wss"
+		}
+		data.WebSocketURL = template.URL(u.String())
+	}
+	return data, true
+}
+
+// isHTTPS reports whether the browser reached us over https, directly or
+// through a trusted proxy
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	peer := clientPeer(r)
+	return containsIP(cfg.trustedProxies, peer) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
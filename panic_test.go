@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// a panic in the room's loop restarts it with its state intact
+func TestRoomSurvivesPanic(t *testing.T) {
+	r := newTestRoom(t, "panic-room")
+	alice := joinTestRoom(t, r, "alice")
+	alice.send("before")
+	alice.expect("message")
+
+	r.do(func() {
+		panic("injected")
+	})
+
+	alice.send("after")
+	if e := alice.expect("message"); e.Message != "after" || e.Seq != 2 {
+		t.Fatalf("got %+v, want after as seq 2", e)
+	}
+	bob := joinTestRoom(t, r, "bob")
+	alice.expectSystem("bob")
+	bob.send("hi")
+	alice.expect("message")
+}
+
+// a panic in a client's read loop disconnects that client only
+func TestClientPanicDisconnectsOnlyIt(t *testing.T) {
+	r := newTestRoom(t, "panic-client")
+	alice := joinTestRoom(t, r, "alice")
+	bob := joinTestRoom(t, r, "bob")
+	alice.expectSystem("bob")
+
+	select {
+	case bob.fake.panics <- "injected":
+	case <-time.After(testTimeout):
+		t.Fatal("bob's read() is not reading")
+	}
+	alice.expectSystem("bob")
+	select {
+	case <-bob.done:
+	case <-time.After(testTimeout):
+		t.Fatal("write() of the panicked client did not exit")
+	}
+
+	alice.send("still here")
+	if e := alice.expect("message"); e.Message != "still here" {
+		t.Fatalf("got %+v, want still here", e)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores anything past 72 bytes, so longer passwords are refused
+const (
+	minRoomPasswordLen = 4
+	maxRoomPasswordLen = 72
+)
+
+// the room password is sent in this header, never in the URL where access
+// logs would keep it; browsers can't set it on WebSockets and send an
+// "auth" frame instead, see authenticate
+const roomPasswordHeader = "X-Room-Password"
+
+// how long a connection to a protected room may take to send its "auth" frame
+const authTimeout = 10 * time.Second
+
+// roomPasswordHash returns the hash protecting the named room, nil when it
+// is open or doesn't exist; archived rooms keep theirs
+func roomPasswordHash(name string) []byte {
+	if r, ok := lookupRoom(name); ok {
+		var hash []byte
+		r.do(func() {
+			hash = r.passwordHash
+		})
+		return hash
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return archivedRooms[name].PasswordHash
+}
+
+// passwordMatches reports whether password opens a room protected by hash,
+// any password opens an open room. Called outside rooms' loops, bcrypt is
+// deliberately slow.
+func passwordMatches(hash []byte, password string) bool {
+	return hash == nil || bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// checkRoomPassword reports whether a request may use the named room: open
+// rooms and moderators always may, everyone else needs the room's password
+// in X-Room-Password
+func checkRoomPassword(name string, req *http.Request) bool {
+	if isModerator(req) {
+		return true
+	}
+	return passwordMatches(roomPasswordHash(name), req.Header.Get(roomPasswordHeader))
+}
+
+// authFrame is the first frame a browser sends to a protected room
+type authFrame struct {
+	Type     string `json:"type"`
+	Password string `json:"password"`
+}
+
+// authenticate waits for the client's {"type":"auth","password":"..."}
+// frame, reporting whether it opens a room protected by hash
+func (c *client) authenticate(hash []byte) bool {
+	c.transport.SetReadDeadline(time.Now().Add(authTimeout))
+	msg, err := c.transport.Read()
+	if err != nil {
+		return false
+	}
+	var auth authFrame
+	if err := json.Unmarshal(msg, &auth); err != nil || auth.Type != "auth" {
+		return false
+	}
+	return passwordMatches(hash, auth.Password)
+}
+
+// refuse sends a client that never joined its room an error and closes the
+// connection, for refusals that browsers could not read from an HTTP status
+func (c *client) refuse(code, key string, args ...any) {
+	msg, err := c.encode(&envelope{Type: "error", Code: code, Message: translate(c.lang, key, args...)})
+	c.transport.SetWriteDeadline(time.Now().Add(cfg.writeWait))
+	if err == nil && msg != nil {
+		c.transport.Write(msg)
+	}
+	c.transport.WriteClose(websocket.ClosePolicyViolation, code)
+	c.transport.Close()
+}
+
+// setPasswordCommand handles /setpass <password>, protecting the room with a
+// new password or replacing the current one. Connected clients stay, only
+// new joins need it. Changes are limited to one per PASSWORD_COOLDOWN.
+func (r *room) setPasswordCommand(c *client, args []string) {
+	if !c.moderator {
+		r.reject(c, errForbidden, "moderators_only")
+		return
+	}
+	if len(args) != 1 || len(args[0]) < minRoomPasswordLen || len(args[0]) > maxRoomPasswordLen {
+		r.reject(c, errInvalidCommand, "setpass_usage", minRoomPasswordLen, maxRoomPasswordLen)
+		return
+	}
+	if wait := cfg.passwordCooldown - time.Since(r.passwordChanged); !r.passwordChanged.IsZero() && wait > 0 {
+		r.reject(c, errRateLimited, "setpass_cooldown", wait.Round(time.Second))
+		return
+	}
+	r.passwordChanged = time.Now()
+
+	// hash off the room's loop and apply the result back on it
+	password, name, room := args[0], c.name, r.name
+	go func() {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("Hashing password of room %q failed: %v", room, err)
+			return
+		}
+		r.do(func() {
+			r.passwordHash = hash
+			r.saveRoomConfig()
+			r.announce("password_changed", name)
+		})
+	}()
+}
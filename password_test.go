@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the password a moderator sets is the one typed, shortcodes and all
+func TestSetPasswordKeepsText(t *testing.T) {
+	withConfig(t, func(c *config) {
+		c.emojiShortcodes = true
+	})
+	r := newTestRoom(t, "setpass")
+	mod := joinTestRoom(t, r, "mod")
+	r.do(func() {
+		mod.moderator = true
+	})
+	mod.send("/setpass a:smile:b")
+
+	// bcrypt takes a while, all the more with the race detector
+	var hash []byte
+	for deadline := time.Now().Add(10 * time.Second); hash == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		r.do(func() {
+			hash = r.passwordHash
+		})
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte("a:smile:b")); err != nil {
+		t.Fatalf("the room password is not the one typed: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxPollOptions     = 10
+	maxPollQuestionLen = 200
+	maxPollOptionLen   = 100
+
+	// a room only remembers its most recent polls
+	maxPolls = 20
+)
+
+// poll is a question with fixed options that clients vote on, owned by room.run()
+type poll struct {
+	id       int
+	creator  string
+	owner    string
+	question string
+	options  []string
+
+	// each voter's current vote by client identity, so votes can be changed
+	// but not repeated, not even by reconnecting
+	votes map[string]int
+
+	closed  bool
+	created time.Time
+	timer   *time.Timer
+}
+
+// envelope returns the current tally of the poll
+func (p *poll) envelope() *envelope {
+	counts := make([]int, len(p.options))
+	for _, option := range p.votes {
+		counts[option]++
+	}
+	return &envelope{
+		Type:     "poll",
+		PollID:   p.id,
+		Name:     p.creator,
+		Question: p.question,
+		Options:  p.options,
+		Counts:   counts,
+		Closed:   p.closed,
+	}
+}
+
+// createPoll handles /poll "Question?" "option 1" "option 2" ...
+func (r *room) createPoll(c *client, args []string) {
+	if len(args) < 3 {
+		r.reject(c, errInvalidCommand, "poll_usage")
+		return
+	}
+	question, options := args[0], args[1:]
+	if len(options) > maxPollOptions {
+		r.reject(c, errInvalidMessage, "poll_too_many_options", maxPollOptions)
+		return
+	}
+	if question == "" || utf8.RuneCountInString(question) > maxPollQuestionLen {
+		r.reject(c, errInvalidMessage, "poll_question_length", maxPollQuestionLen)
+		return
+	}
+	for _, option := range options {
+		if option == "" || utf8.RuneCountInString(option) > maxPollOptionLen {
+			r.reject(c, errInvalidMessage, "poll_option_length", maxPollOptionLen)
+			return
+		}
+	}
+
+	r.lastPoll++
+	p := &poll{
+		id:       r.lastPoll,
+		creator:  c.name,
+		owner:    c.identity,
+		question: question,
+		options:  options,
+		votes:    make(map[string]int),
+		created:  time.Now(),
+	}
+	r.polls[p.id] = p
+
+	// forget the oldest polls so long-lived rooms don't grow without bound
+	for id, old := range r.polls {
+		if id <= p.id-maxPolls {
+			if old.timer != nil {
+				old.timer.Stop()
+			}
+			delete(r.polls, id)
+		}
+	}
+
+	if cfg.pollTimeout > 0 {
+		r.closeAfter(p, cfg.pollTimeout)
+	}
+
+	r.broadcast(p.envelope())
+	record := p.envelope()
+	record.Time = p.created.UnixMilli()
+	record.author = p.owner
+	saveMessage(r.name, record)
+}
+
+// closeAfter closes p once d has passed
+func (r *room) closeAfter(p *poll, d time.Duration) {
+	p.timer = time.AfterFunc(d, func() {
+		r.submit(&envelope{Type: "closepoll", PollID: p.id})
+	})
+}
+
+// restorePolls puts back the polls loaded from the store with the history,
+// restarting the timeout of those still open; called before the room runs
+func (r *room) restorePolls(polls []*poll) {
+	for _, p := range polls {
+		r.polls[p.id] = p
+		r.lastPoll = max(r.lastPoll, p.id)
+		if !p.closed && cfg.pollTimeout > 0 {
+			r.closeAfter(p, cfg.pollTimeout-time.Since(p.created))
+		}
+	}
+}
+
+// vote records a client's vote and broadcasts the live tally
+func (r *room) vote(e *envelope) {
+	p, ok := r.polls[e.PollID]
+	if !ok {
+		r.reject(e.from, errNotFound, "poll_not_found")
+		return
+	}
+	if p.closed {
+		r.reject(e.from, errPollClosed, "poll_closed")
+		return
+	}
+	if e.Option == nil || *e.Option < 0 || *e.Option >= len(p.options) {
+		r.reject(e.from, errInvalidMessage, "poll_invalid_option")
+		return
+	}
+
+	// voting again replaces the previous vote
+	if previous, voted := p.votes[e.from.identity]; voted && previous == *e.Option {
+		return
+	}
+	p.votes[e.from.identity] = *e.Option
+
+	r.broadcast(p.envelope())
+	saveMessage(r.name, &envelope{Type: "vote", PollID: p.id, Option: e.Option, author: e.from.identity})
+}
+
+// closePollCommand handles /closepoll <id>, only the poll's creator may close it
+func (r *room) closePollCommand(c *client, args []string) {
+	if len(args) != 1 {
+		r.reject(c, errInvalidCommand, "closepoll_usage")
+		return
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil || r.polls[id] == nil {
+		r.reject(c, errNotFound, "poll_not_found")
+		return
+	}
+	if r.polls[id].owner != c.identity {
+		r.reject(c, errForbidden, "closepoll_not_owner")
+		return
+	}
+	r.closePoll(id)
+}
+
+// closePoll stops accepting votes and broadcasts the final tally
+func (r *room) closePoll(id int) {
+	p, ok := r.polls[id]
+	if !ok || p.closed {
+		return
+	}
+	p.closed = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	final := p.envelope()
+	r.broadcast(final)
+	// the votes are stored already, the tally is kept for readers of the store
+	saveMessage(r.name, &envelope{Type: "closepoll", PollID: id, Counts: final.Counts})
+}
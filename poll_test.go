@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// reconnecting doesn't give a second vote, and whoever joins is sent the
+// open polls with their tally
+func TestPollVotesByIdentity(t *testing.T) {
+	r := newTestRoom(t, "polls")
+	alice := joinTestRoom(t, r, "alice")
+	alice.send(`/poll "Lunch?" pizza sushi`)
+	p := alice.expect("poll")
+	alice.send(`/poll "Closed?" yes no`)
+	closed := alice.expect("poll")
+	alice.send(`/closepoll 2`)
+	alice.expect("poll")
+
+	alice.send(`{"type":"vote","pollId":1,"option":0}`)
+	if e := alice.expect("poll"); !slices.Equal(e.Counts, []int{1, 0}) {
+		t.Fatalf("tally %v after one vote", e.Counts)
+	}
+	alice.leave()
+	<-alice.done
+
+	alice = joinTestRoom(t, r, "alice")
+	replayed := alice.expect("poll")
+	if replayed.PollID != p.PollID || !slices.Equal(replayed.Counts, []int{1, 0}) {
+		t.Fatalf("replayed %+v, want poll %d with its vote", replayed, p.PollID)
+	}
+	alice.send(`{"type":"vote","pollId":1,"option":1}`)
+	if e := alice.expect("poll"); !slices.Equal(e.Counts, []int{0, 1}) {
+		t.Fatalf("tally %v after changing the vote, want it moved rather than added", e.Counts)
+	}
+
+	bob := joinTestRoom(t, r, "bob")
+	if e := bob.expect("poll"); e.PollID != p.PollID || e.PollID == closed.PollID {
+		t.Fatalf("bob was replayed %+v, want only the open poll", e)
+	}
+	alice.send(`/closepoll 1`)
+	if e := bob.expect("poll"); !e.Closed {
+		t.Fatalf("the creator could not close the poll after reconnecting: %+v", e)
+	}
+}
+
+// polls, votes and closes are saved with the messages and rebuilt when the
+// room is opened again, with each voter still holding a single vote
+func TestPollsSurviveStore(t *testing.T) {
+	withStore(t)
+	r := newTestRoom(t, "polls-stored")
+	alice := joinTestRoom(t, r, "alice")
+	alice.send(`/poll "Lunch?" pizza sushi`)
+	p := alice.expect("poll")
+	alice.send(`/poll "Closed?" yes no`)
+	alice.expect("poll")
+	alice.send(`{"type":"vote","pollId":1,"option":0}`)
+	alice.expect("poll")
+	alice.send(`/closepoll 2`)
+	alice.expect("poll")
+	alice.send("after the polls")
+	alice.expect("message")
+
+	closeRoom(r.room, "")
+	<-r.quit
+	flushStore(t)
+
+	r = newTestRoom(t, "polls-stored")
+	alice = joinTestRoom(t, r, "alice")
+	replayed := alice.expect("poll")
+	if replayed.PollID != p.PollID || replayed.Closed || !slices.Equal(replayed.Counts, []int{1, 0}) {
+		t.Fatalf("replayed %+v, want poll %d open with its vote", replayed, p.PollID)
+	}
+	alice.send(`{"type":"vote","pollId":1,"option":1}`)
+	if e := alice.expect("poll"); !slices.Equal(e.Counts, []int{0, 1}) {
+		t.Fatalf("tally %v after changing the stored vote, want it moved rather than added", e.Counts)
+	}
+	alice.send(`{"type":"vote","pollId":2,"option":0}`)
+	if e := alice.expect("error"); e.Code != errPollClosed {
+		t.Fatalf("voting on the closed poll got %+v, want %s", e, errPollClosed)
+	}
+	alice.send(`/poll "Next?" a b`)
+	if e := alice.expect("poll"); e.PollID != 3 {
+		t.Fatalf("new poll got id %d, want 3", e.PollID)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+const (
+	statusOnline = "online"
+	statusAway   = "away"
+)
+
+// touch records activity from a client, bringing it back online if it was away
+func (r *room) touch(c *client) {
+	if !r.clients[c] {
+		return
+	}
+	c.lastActive = time.Now()
+	if c.status == statusAway {
+		r.setStatus(c, statusOnline)
+	}
+}
+
+// markAway moves clients without recent activity to away
+func (r *room) markAway() {
+	for c := range r.clients {
+		if !c.bot && !c.monitor && c.status == statusOnline && time.Since(c.lastActive) >= cfg.awayAfter {
+			r.setStatus(c, statusAway)
+		}
+	}
+}
+
+// setStatus changes a client's presence and broadcasts it to the room
+func (r *room) setStatus(c *client, status string) {
+	c.status = status
+	r.broadcast(&envelope{Type: "presence", Name: c.name, Status: status, Bot: c.bot, Avatar: c.avatar})
+}
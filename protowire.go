@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"maps"
+	"slices"
+)
+
+// subprotocol of the binary wire format, see envelope.proto
+const protoSubprotocol = "chat.v2.proto"
+
+// protobuf wire types used by envelope.proto
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// encodeProto renders e as the Envelope of envelope.proto. The fields are
+// few and flat, so they are written by hand in field order instead of
+// through generated code.
+func encodeProto(e *envelope) []byte {
+	b := make([]byte, 0, 64+len(e.Message)+len(e.HTML))
+	b = appendProtoString(b, 1, e.Type)
+	b = appendProtoInt(b, 2, int64(e.V))
+	b = appendProtoUint(b, 3, e.Seq)
+	b = appendProtoInt(b, 4, e.Time)
+	b = appendProtoString(b, 5, e.TimeText)
+	b = appendProtoString(b, 6, e.Name)
+	b = appendProtoString(b, 7, e.Message)
+	b = appendProtoBool(b, 8, e.Bot)
+	b = appendProtoString(b, 9, e.Avatar)
+	b = appendProtoString(b, 10, e.HTML)
+	b = appendProtoString(b, 11, e.Format)
+	b = appendProtoString(b, 12, e.ClientMsgID)
+	b = appendProtoBool(b, 13, e.Deleted)
+	b = appendProtoBool(b, 14, e.Ephemeral)
+	b = appendProtoInt(b, 15, e.EditedAt)
+	b = appendProtoString(b, 16, e.Status)
+	b = appendProtoString(b, 17, e.Reason)
+	b = appendProtoString(b, 18, e.Code)
+	b = appendProtoBool(b, 19, e.Forwarded)
+	b = appendProtoString(b, 20, e.Room)
+	b = appendProtoString(b, 21, e.URL)
+	b = appendProtoString(b, 22, e.Title)
+	b = appendProtoString(b, 23, e.Description)
+	b = appendProtoString(b, 24, e.Image)
+	b = appendProtoInt(b, 25, int64(e.PollID))
+	b = appendProtoString(b, 26, e.Question)
+	for _, option := range e.Options {
+		b = appendProtoTag(b, 27, wireBytes)
+		b = appendProtoBytes(b, []byte(option))
+	}
+	if len(e.Counts) > 0 {
+		var packed []byte
+		for _, n := range e.Counts {
+			packed = binary.AppendUvarint(packed, uint64(int64(n)))
+		}
+		b = appendProtoTag(b, 28, wireBytes)
+		b = appendProtoBytes(b, packed)
+	}
+	b = appendProtoBool(b, 29, e.Closed)
+	if e.Option != nil {
+		b = appendProtoTag(b, 30, wireVarint)
+		b = binary.AppendUvarint(b, uint64(int64(*e.Option)))
+	}
+	// map entries are sorted so equal envelopes encode the same
+	for _, name := range slices.Sorted(maps.Keys(e.Receipts)) {
+		var entry []byte
+		entry = appendProtoString(entry, 1, name)
+		entry = appendProtoUint(entry, 2, e.Receipts[name])
+		b = appendProtoTag(b, 31, wireBytes)
+		b = appendProtoBytes(b, entry)
+	}
+	b = appendProtoString(b, 32, e.Session)
+	b = appendProtoString(b, 33, e.Color)
+	b = appendProtoInt(b, 34, int64(e.Users))
+	if e.MessagesPerMin != nil {
+		b = appendProtoTag(b, 35, wireVarint)
+		b = binary.AppendUvarint(b, uint64(int64(*e.MessagesPerMin)))
+	}
+	b = appendProtoInt(b, 36, e.At)
+	b = appendProtoInt(b, 37, int64(e.ID))
+	b = appendProtoInt(b, 38, e.After)
+	b = appendProtoBool(b, 39, e.Jitter)
+	b = appendProtoString(b, 40, e.Previous)
+	return b
+}
+
+func appendProtoTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoBytes(b, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// the appendProto* helpers leave zero values out, as proto3 does
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendProtoTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendProtoUint(b []byte, field int, n uint64) []byte {
+	if n == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, wireVarint)
+	return binary.AppendUvarint(b, n)
+}
+
+// negative numbers take ten bytes, as for protobuf's int32 and int64
+func appendProtoInt(b []byte, field int, n int64) []byte {
+	return appendProtoUint(b, field, uint64(n))
+}
+
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoUint(b, field, 1)
+}
@@ -0,0 +1,35 @@
+package main
+
+import "time"
+
+// markSeen handles {"type":"seen","seq":N} from a client
+func (r *room) markSeen(e *envelope) {
+	// ignore stale acknowledgements and seqs that were never sent
+	if e.Seq <= r.seen[e.from] || e.Seq > r.seq {
+		return
+	}
+	r.seen[e.from] = e.Seq
+
+	// coalesce rapid updates into one broadcast per interval
+	if r.receiptsPending {
+		return
+	}
+	r.receiptsPending = true
+	time.AfterFunc(cfg.receiptInterval, func() {
+		r.submit(&envelope{Type: "flushreceipts"})
+	})
+}
+
+// flushReceipts broadcasts the last seen seq of every client in the room
+func (r *room) flushReceipts() {
+	r.receiptsPending = false
+
+	receipts := make(map[string]uint64, len(r.seen))
+	for c, seq := range r.seen {
+		receipts[c.name] = seq
+	}
+	if len(receipts) == 0 {
+		return
+	}
+	r.broadcast(&envelope{Type: "receipts", Receipts: receipts})
+}
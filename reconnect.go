@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// reconnectHint tells a client being disconnected by the server when to come
+// back: RECONNECT_AFTER, stretched by one more RECONNECT_AFTER for every
+// RECONNECT_LOAD_STEP connections so a big restart spreads out more, with
+// the client asked to add random jitter on top
+func reconnectHint() *envelope {
+	after := cfg.reconnectAfter
+	if cfg.reconnectLoadStep > 0 {
+		after += after * time.Duration(connections.Load()/int64(cfg.reconnectLoadStep))
+	}
+	return &envelope{Type: "reconnect", After: after.Milliseconds(), Jitter: cfg.reconnectJitter}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// RoomRenamer is implemented by stores that can move a room's history and
+// configuration to a new name
+type RoomRenamer interface {
+	// RenameRoom moves everything stored under from to to
+	RenameRoom(from, to string) error
+}
+
+// renameRequest is the body of PUT /rooms/{name}
+type renameRequest struct {
+	Name string `json:"name"`
+}
+
+// why renameRoom refused: the new name is in use, or the room is closing
+var (
+	errRoomExists = errors.New("room exists")
+	errRoomClosed = errors.New("room closed")
+)
+
+// renameRoom moves the room to a new name. The room's loop is paused and mu
+// held while the name changes, so run() and anyone holding mu always see
+// one name, and a join racing the rename either finds the room under the
+// new name or gets a fresh room under the old one.
+func (r *room) renameRoom(to string) (string, error) {
+	var from string
+	err := errRoomClosed
+	r.do(func() {
+		mu.Lock()
+		if r.state != roomActive {
+			err = errRoomClosed
+		} else if existing, ok := rooms[to]; ok && existing.state == roomActive {
+			err = errRoomExists
+		} else if _, ok := archivedRooms[to]; ok {
+			err = errRoomExists
+		} else {
+			from, err = r.name, nil
+			delete(rooms, from)
+			rooms[to] = r
+			r.name = to
+		}
+		mu.Unlock()
+		if err != nil {
+			return
+		}
+
+		queueStoreRename(from, to)
+		r.saveRoomConfig()
+		r.announce("room_renamed", to)
+		r.broadcast(&envelope{Type: "room", Room: to, Previous: from})
+	})
+	return from, err
+}
+
+// queueStoreRename asks the store writer to move the room's stored history
+// after the messages already queued under the old name
+func queueStoreRename(from, to string) {
+	if _, ok := store.(RoomRenamer); !ok || storeQueue == nil {
+		return
+	}
+	select {
+	case storeQueue <- storedMessage{room: from, renameTo: to}:
+	case <-storeWriterDone:
+	}
+}
+
+// renameStoredRoom runs a queued rename on the store writer's goroutine
+func renameStoredRoom(from, to string) {
+	err := storeBreaker.call(func() error {
+		return store.(RoomRenamer).RenameRoom(from, to)
+	})
+	if err != nil {
+		log.Printf("Renaming stored room %q to %q failed: %v", from, to, err)
+	}
+}
+
+// renameRoomHandler serves PUT /rooms/{name} with {"name":"<new name>"},
+// renaming an open room behind ADMIN_TOKEN
+func renameRoomHandler(w http.ResponseWriter, req *http.Request) {
+	if cfg.adminToken == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	r, ok := lookupRoom(req.PathValue("name"))
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	var body renameRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1024)).Decode(&body); err != nil || !validRoomName(body.Name) {
+		http.Error(w, "Body must be {\"name\":\"<valid room name>\"}", http.StatusBadRequest)
+		return
+	}
+
+	// the new name must not have history of its own to merge into
+	if store != nil {
+		var history []*envelope
+		err := storeBreaker.call(func() error {
+			var err error
+			history, err = store.Recent(body.Name, 1)
+			return err
+		})
+		if err != nil {
+			http.Error(w, "Message store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if len(history) > 0 {
+			http.Error(w, "A room with that name exists", http.StatusConflict)
+			return
+		}
+	}
+
+	from, err := r.renameRoom(body.Name)
+	switch {
+	case errors.Is(err, errRoomExists):
+		http.Error(w, "A room with that name exists", http.StatusConflict)
+		return
+	case err != nil:
+		http.NotFound(w, req)
+		return
+	}
+	emit(roomEvent{kind: eventRoomRenamed, room: body.Name, previous: from})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"slices"
+)
+
+// replay sends a joining client the room's history, the newest messages
+// that fit in HISTORY_REPLAY_BYTES of its wire format when that is set,
+// telling it how many older ones were left out, followed by the open
+// polls; called from run()
+func (r *room) replay(c *client) {
+	var msgs [][]byte
+	size, skipped := 0, 0
+	for i := len(r.history) - 1; i >= 0; i-- {
+		e := r.history[i]
+		if e.Deleted {
+			continue
+		}
+		if skipped > 0 {
+			skipped++
+			continue
+		}
+		msg, err := c.encode(e)
+		if err != nil {
+			log.Println("Encoding failed:", err)
+			continue
+		}
+		if msg == nil {
+			continue
+		}
+		if cfg.historyReplayBytes > 0 && size+len(msg) > cfg.historyReplayBytes {
+			skipped++
+			continue
+		}
+		size += len(msg)
+		msgs = append(msgs, msg)
+	}
+
+	if skipped > 0 {
+		r.notify(c, "history_truncated", skipped)
+	}
+	for i := len(msgs) - 1; i >= 0; i-- {
+		r.deliver(c, msgs[i])
+	}
+
+	// then the polls still taking votes, with their current tally
+	ids := make([]int, 0, len(r.polls))
+	for id, p := range r.polls {
+		if !p.closed {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		r.send(c, r.polls[id].envelope())
+	}
+}
@@ -1,16 +1,35 @@
 package main
 
 import (
-	"fmt"
+	"crypto/rand"
+	"crypto/subtle"
+	"expvar"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
 )
 
 type room struct {
+	// changed only by renameRoom, on the room's goroutine with mu held, so
+	// read it from run() or under mu
+	name string
+
+	// when the room was created, set once in newRoom
+	created time.Time
+
+	// last join or chat message, only touched by run(); archiving is set
+	// once the room has been handed to archiveRoom
+	lastActivity time.Time
+	archiving    bool
 
 	// hold all current clients in room as a map
 	clients map[*client]bool
@@ -20,34 +39,579 @@ type room struct {
 	leave chan *client
 
 	// broadcast channel for sending messages to all clients
-	forward chan []byte
+	forward chan *envelope
+
+	// higher priority channel for error notices and state updates, see controlTypes
+	control chan *envelope
+
+	// functions to run inside run(), so other goroutines can read room state
+	exec chan func()
+
+	// sequence number of the last chat message, only touched by run()
+	seq uint64
+
+	// the most recent chat messages, replayed to clients when they join,
+	// at most historySize of them (HISTORY_SIZE unless changed with /history)
+	history     []*envelope
+	historySize int
+
+	// read-only maintenance mode set by /pause, only touched by run()
+	paused bool
+
+	// polls created in this room by id, only touched by run()
+	polls    map[int]*poll
+	lastPoll int
+
+	// the last seq each client has seen, broadcast at most once per
+	// receiptInterval while receiptsPending is set
+	seen            map[*client]uint64
+	receiptsPending bool
+
+	// messages waiting to be sent at a later time, only touched by run()
+	scheduled     map[int]*scheduledMessage
+	lastScheduled int
+
+	// some client has coalesced updates waiting, see flushUpdates
+	updatesPending bool
+
+	// clients removed by deliverBlocking whose leave is still to be
+	// announced, only touched by run()
+	departed []*client
+
+	// goroutines delivering to clients with FANOUT_MODE=fast, and the next
+	// one assignWorker hands a client to; nil in strict mode
+	fanout     []*fanoutWorker
+	nextWorker int
+
+	// recent chat traffic and the last "stats" broadcast, see broadcastStats
+	activity  activity
+	lastStats liveStats
+
+	// lifecycle stage, guarded by mu, see closeRoom
+	state roomState
+
+	// closing refuses new joins, set under gate which enter holds while
+	// sending on join, so none can be queued after run() drained them
+	gate    sync.RWMutex
+	closing bool
+
+	// run() exits once stopping is set, with the reason clients are given,
+	// and then closes quit so senders stop waiting for it
+	stopping   bool
+	stopReason string
+	quit       chan struct{}
+
+	// message of the day set with /motd, shown to every joining client;
+	// only touched by run()
+	motd string
+
+	// slash commands allowed by /commands, nil when all are; only touched
+	// by run()
+	commands map[string]bool
+
+	// who may send each restricted client type, set with /types; only
+	// touched by run()
+	types map[string]string
+
+	// bcrypt hash of the password set with /setpass, nil for an open room,
+	// and when it was last changed; only touched by run()
+	passwordHash    []byte
+	passwordChanged time.Time
 }
 
-func newRoom() *room {
+func newRoom(name string) *room {
 	return &room{
-		forward: make(chan []byte),
-		join:    make(chan *client),
-		leave:   make(chan *client),
+		name:    name,
+		created: time.Now(),
+
+		lastActivity: time.Now(),
+
+		historySize: cfg.historySize,
+
+		forward: make(chan *envelope),
+		control: make(chan *envelope, controlQueueSize),
+		exec:    make(chan func()),
+		quit:    make(chan struct{}),
+		join:    make(chan *client, cfg.joinQueueSize),
+		leave:   make(chan *client, cfg.joinQueueSize),
 		clients: make(map[*client]bool),
+		polls:   make(map[int]*poll),
+		seen:    make(map[*client]uint64),
+
+		scheduled: make(map[int]*scheduledMessage),
 	}
 }
 
 // each room is a separete thread that should be run independently of the main thread
 func (r *room) run() {
+	roomLoops.Add(1)
+	defer roomLoops.Add(-1)
+
+	// a bug handling one message must not take the room down with it, the
+	// state lives on the room so the loop simply starts over
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("panic in room %q, restarting it: %v\n%s", r.name, err, debug.Stack())
+			go r.run()
+		}
+	}()
+
+	// periodically look for idle clients when automatic away is enabled
+	var awayCheck <-chan time.Time
+	if cfg.awayAfter > 0 {
+		ticker := time.NewTicker(cfg.awayAfter / 2)
+		defer ticker.Stop()
+		awayCheck = ticker.C
+	}
+
+	// periodically look for inactivity when rooms are archived
+	var archiveCheck <-chan time.Time
+	if archiveEnabled() {
+		ticker := time.NewTicker(min(cfg.roomArchiveAfter/2, time.Minute))
+		defer ticker.Stop()
+		archiveCheck = ticker.C
+	}
+
+	// periodically tell the room how busy it is when enabled
+	var statsTick <-chan time.Time
+	if cfg.statsInterval > 0 {
+		ticker := time.NewTicker(cfg.statsInterval)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
+
 	for {
+		// leaves taken while a delivery was blocked are announced once the
+		// event that blocked is done, so nobody sees them mid-broadcast;
+		// announcing may block and take more of them
+		for len(r.departed) > 0 {
+			c := r.departed[0]
+			r.departed = r.departed[1:]
+			r.announceLeave(c)
+		}
+
+		// hand what the last event queued over to the fanout workers
+		r.flushFanout()
+
+		// control envelopes go first so a flood of chat can't hold them up
 		select {
+		case e := <-r.control:
+			r.handle(e)
+			continue
+		default:
+		}
+
+		select {
+		case e := <-r.control:
+			r.handle(e)
 		// adding a user to the room/channel
 		case client := <-r.join:
+			// with buffered channels a client may leave before its join is handled
+			if client.left {
+				break
+			}
+			if !client.monitor {
+				r.uniqueName(client)
+				// from the final name, so two tabs joining as alice from
+				// one IP are alice and alice2 with messages of their own
+				client.identity = clientIdentity(client.ip, client.name)
+				// monitors are queued to by run() itself, see deliver
+				r.assignWorker(client)
+			}
 			r.clients[client] = true
+			client.status = statusOnline
+			client.lastActive = time.Now()
+			r.lastActivity = client.lastActive
+			client.joined = client.lastActive
+			if !client.monitor {
+				r.welcome(client)
+				if r.motd != "" {
+					r.send(client, &envelope{Type: "system", Message: r.motd})
+				}
+				r.announce("joined", client.name)
+				emit(roomEvent{kind: eventJoin, room: r.name, client: client.name})
+			}
+			r.replay(client)
 		//removing a user from the room/channel
 		case client := <-r.leave:
-			delete(r.clients, client)
-			close(client.receive)
+			if r.removeLeaving(client) {
+				r.announceLeave(client)
+			}
 		// forward message to all clients
-		case msg := <-r.forward:
-			for client := range r.clients {
-				client.receive <- msg
+		case e := <-r.forward:
+			r.handle(e)
+		// run a request for room state from another goroutine
+		case f := <-r.exec:
+			f()
+			if r.stopping {
+				r.stop()
+				return
 			}
+		// move idle clients to away
+		case <-awayCheck:
+			r.markAway()
+		// broadcast room activity
+		case <-statsTick:
+			r.broadcastStats()
+		// archive the room once it has been inactive long enough
+		case <-archiveCheck:
+			r.checkArchive()
+		}
+	}
+}
+
+// do runs f on the room's goroutine and waits for it to finish, f doesn't
+// run once the room has been closed
+func (r *room) do(f func()) {
+	done := make(chan struct{})
+	select {
+	case r.exec <- func() {
+		defer close(done)
+		f()
+	}:
+	case <-r.quit:
+		return
+	}
+	<-done
+}
+
+// controlTypes are envelopes run() handles ahead of queued chat: error
+// notices and state updates that don't depend on any chat message still
+// waiting on forward. Anything that refers to earlier messages (edits,
+// votes, commands) stays on forward to keep each client's order.
+var controlTypes = map[string]bool{
+	"notify":        true,
+	"seen":          true,
+	"flushreceipts": true,
+	"flushupdates":  true,
+}
+
+// room envelopes in control may wait for run() without blocking their sender
+const controlQueueSize = 64
+
+// submit queues an envelope for run(), on control or forward by its type
+func (r *room) submit(e *envelope) {
+	ch := r.forward
+	if controlTypes[e.Type] {
+		ch = r.control
+	}
+	// a closed room drops whatever is still sent to it
+	select {
+	case ch <- e:
+	case <-r.quit:
+	}
+}
+
+// handle processes a single envelope arriving on the forward or control channel
+func (r *room) handle(e *envelope) {
+	if e.from != nil {
+		// names and avatars change in run(), so the sender is stamped here
+		// rather than in read()
+		e.Name = e.from.name
+		e.Avatar = e.from.avatar
+		e.author = e.from.identity
+		// anything a client sends counts as activity; scheduled messages
+		// and notices for it don't, nor do server pings, which never reach here
+		if e.received {
+			r.touch(e.from)
+		}
+
+		if !r.typeAllowed(e) {
+			r.rejectType(e.from, e.Type)
+			return
+		}
+	}
+
+	switch e.Type {
+	case "message":
+		if e.from != nil && strings.HasPrefix(e.Message, "/") {
+			r.command(e)
+			return
+		}
+
+		r.post(e)
+	case "notify":
+		if e.Code != "" {
+			r.reject(e.from, e.Code, e.key, e.args...)
+		} else {
+			r.notify(e.from, e.key, e.args...)
+		}
+	case "vote":
+		r.vote(e)
+	case "closepoll":
+		r.closePoll(e.PollID)
+	case "edit":
+		r.edit(e)
+	case "seen":
+		r.markSeen(e)
+	case "flushreceipts":
+		r.flushReceipts()
+	case "flushupdates":
+		r.flushUpdates()
+	case "schedule":
+		r.schedule(e)
+	case "unschedule":
+		r.unschedule(e)
+	case "sendscheduled":
+		r.sendScheduled(e.ID)
+	default:
+		r.broadcast(e)
+	}
+}
+
+// post sends a chat message to the room
+func (r *room) post(e *envelope) {
+	// while paused only moderators can post
+	if r.paused && (e.from == nil || !e.from.moderator) {
+		if e.from != nil {
+			r.reject(e.from, errRoomPaused, "room_paused")
+		}
+		return
+	}
+
+	// a retried send is answered with the original ack, not broadcast again
+	clientMsgID := e.ClientMsgID
+	e.ClientMsgID = ""
+	if len(clientMsgID) > maxClientMsgIDLen {
+		clientMsgID = ""
+	}
+	if clientMsgID != "" {
+		if seq, ok := e.from.acks.lookup(clientMsgID); ok {
+			r.send(e.from, &envelope{Type: "ack", ClientMsgID: clientMsgID, Seq: seq})
+			return
+		}
+	}
+
+	// html only ever comes from the server's own rendering
+	e.HTML = ""
+	if cfg.markdown && e.Format != "code" {
+		e.HTML = renderMarkdown(e.Message)
+	}
+
+	r.seq++
+	e.Seq = r.seq
+	e.Time = time.Now().UnixMilli()
+	r.activity.add(time.UnixMilli(e.Time))
+	r.lastActivity = time.Now()
+	r.broadcast(e)
+	if clientMsgID != "" {
+		r.ack(e.from, clientMsgID, e.Seq)
+	}
+	if e.Ephemeral {
+		// nothing to edit, link to or replay later, so nothing more to do
+		return
+	}
+	r.remember(e)
+	saveMessage(r.name, e)
+	if hookEvents != nil {
+		// hooks get a snapshot, the room keeps editing its own copy
+		snapshot := *e
+		emit(roomEvent{kind: eventMessage, room: r.name, client: e.Name, message: &snapshot})
+	}
+
+	// previews are fetched in the background and broadcast as a follow-up
+	if cfg.unfurlLinks {
+		if link := findLink(e.Message); link != "" {
+			go r.unfurl(e.Seq, link)
+		}
+	}
+}
+
+// remember appends a chat message to the history, dropping the oldest
+// once the history is full
+func (r *room) remember(e *envelope) {
+	if r.historySize <= 0 {
+		return
+	}
+	r.trimHistory(r.historySize - 1)
+	r.history = append(r.history, e)
+	e.from = nil
+}
+
+// trimHistory drops the oldest messages until at most n are left
+func (r *room) trimHistory(n int) {
+	if len(r.history) > n {
+		copy(r.history, r.history[len(r.history)-n:])
+		clear(r.history[n:])
+		r.history = r.history[:n]
+	}
+}
+
+// findMessage returns the chat message with the given seq from the history,
+// or nil if it was never sent, has been deleted or has already been dropped
+func (r *room) findMessage(seq uint64) *envelope {
+	for _, e := range r.history {
+		if e.Seq == seq && !e.Deleted {
+			return e
+		}
+	}
+	return nil
+}
+
+// broadcast sends e to every client in the room, encoding it once per
+// distinct client rendering so the common case shares a single []byte
+func (r *room) broadcast(e *envelope) {
+	// fanout workers send on receive instead of run(), so they can't be
+	// sent held back updates
+	key := ""
+	if cfg.coalesceUpdates && r.fanout == nil {
+		key = coalesceKey(e)
+	}
+	rendered := make(map[string][]byte)
+	for client := range r.clients {
+		msg, ok := rendered[client.variant()]
+		if !ok {
+			var err error
+			msg, err = client.encode(e)
+			if err != nil {
+				log.Println("Encoding failed:", err)
+				return
+			}
+			rendered[client.variant()] = msg
+		}
+		if msg == nil {
+			continue
+		}
+		if key != "" {
+			r.deliverUpdate(client, key, msg)
+		} else {
+			r.deliver(client, msg)
+		}
+	}
+}
+
+// send delivers e to a single client
+func (r *room) send(c *client, e *envelope) {
+	// the receive channel is closed once the client has left
+	if !r.clients[c] {
+		return
+	}
+	msg, err := c.encode(e)
+	if err != nil {
+		log.Println("Encoding failed:", err)
+		return
+	}
+	if msg != nil {
+		r.deliver(c, msg)
+	}
+}
+
+// notify sends a system message to a single client in its language
+func (r *room) notify(c *client, key string, args ...any) {
+	r.send(c, &envelope{Type: "system", Message: translate(c.lang, key, args...)})
+}
+
+// welcome sends a joining client everything it needs to set up its view in
+// one message: who it is in this room and how many people are here
+func (r *room) welcome(c *client) {
+	users := 0
+	for other := range r.clients {
+		if !other.monitor {
+			users++
+		}
+	}
+	r.send(c, &envelope{
+		Type:    "welcome",
+		Room:    r.name,
+		Name:    c.name,
+		Color:   c.color,
+		Avatar:  c.avatar,
+		Bot:     c.bot,
+		Session: c.session,
+		Users:   users,
+	})
+}
+
+// disconnect removes a client from the room on the server's initiative. It
+// gets a "closing" message with the reason, then write() drains its queue
+// and closes the socket with code. The client's own leave that follows is
+// ignored as it is no longer in the room.
+func (r *room) disconnect(c *client, reason string, code int) {
+	if !r.clients[c] {
+		return
+	}
+	// only a restart invites clients back, archiving doesn't
+	if reason == "shutdown" {
+		r.send(c, reconnectHint())
+	}
+	r.send(c, &envelope{
+		Type:    "closing",
+		Reason:  reason,
+		Code:    strings.ToUpper(reason),
+		Message: translate(c.lang, "closing_"+reason),
+	})
+	r.remove(c, code, reason)
+}
+
+// remove takes a client out of the room and closes its receive channel, so
+// write() closes the socket with code once the queue has drained
+func (r *room) remove(c *client, code int, reason string) {
+	if !r.clients[c] {
+		return
+	}
+	delete(r.clients, c)
+	delete(r.seen, c)
+	c.close(code, reason)
+	if !cfg.scheduleAfterLeave {
+		r.cancelScheduled(c)
+	}
+	if !c.monitor {
+		emit(roomEvent{kind: eventLeave, room: r.name, client: c.name, reason: reason})
+	}
+}
+
+// removeLeaving takes a client that left on its own out of the room,
+// reporting whether it was in it; called from run()
+func (r *room) removeLeaving(c *client) bool {
+	// already removed when its room was archived or the server is shutting down
+	if !r.clients[c] {
+		// or its join is still queued, which must then be ignored
+		if c.joined.IsZero() {
+			c.left = true
+			c.close(websocket.CloseNormalClosure, "")
+		}
+		return false
+	}
+	delete(r.clients, c)
+	delete(r.seen, c)
+	c.close(websocket.CloseNormalClosure, "")
+	if !cfg.scheduleAfterLeave {
+		r.cancelScheduled(c)
+	}
+	return true
+}
+
+// announceLeave tells the room a client removed by removeLeaving has gone
+func (r *room) announceLeave(c *client) {
+	if c.monitor {
+		return
+	}
+	reason := c.leaveReason
+	if reason == "" {
+		reason = leftNormally
+	}
+	r.announce(leaveMessages[reason], c.name)
+	emit(roomEvent{kind: eventLeave, room: r.name, client: c.name, reason: reason})
+	r.reclaimName(c.name)
+}
+
+// announce broadcasts a system message, rendered once per language and
+// client variant in the room
+func (r *room) announce(key string, args ...any) {
+	rendered := make(map[string][]byte)
+	for client := range r.clients {
+		msg, ok := rendered[client.lang+" "+client.variant()]
+		if !ok {
+			var err error
+			msg, err = client.encode(&envelope{Type: "system", Message: translate(client.lang, key, args...)})
+			if err != nil {
+				log.Println("Encoding failed:", err)
+				return
+			}
+			rendered[client.lang+" "+client.variant()] = msg
+		}
+		if msg != nil {
+			r.deliver(client, msg)
 		}
 	}
 }
@@ -55,58 +619,318 @@ func (r *room) run() {
 var rooms = make(map[string]*room)
 var mu sync.Mutex
 
+// maximum length of a room name in a /chat/{room} URL
+const maxRoomNameLen = 64
+
+// validRoomName reports whether name is usable in a /chat/{room} URL:
+// letters, digits, '-', '_' and '.'
+func validRoomName(name string) bool {
+	if name == "" || len(name) > maxRoomNameLen {
+		return false
+	}
+	for _, ch := range name {
+		if !unicode.IsLetter(ch) && !unicode.IsDigit(ch) && !strings.ContainsRune("-_.", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupRoom returns the room with the given name without creating it
+func lookupRoom(name string) (*room, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	room, ok := rooms[name]
+	if !ok || room.state != roomActive {
+		return nil, false
+	}
+	return room, true
+}
+
 func getRoom(name string) *room {
+	return openRoom(name, nil)
+}
+
+// openRoom returns the active room called name, creating it with the
+// stored configuration rc when there is none; rc is applied before the
+// history is loaded, as its history size decides how much is
+func openRoom(name string, rc *roomConfig) *room {
 
 	// prevent creating a room with same name when multiple users do that st the same time
 	mu.Lock()
 	defer mu.Unlock()
 
-	// if the room name already exists
-	if room, ok := rooms[name]; ok {
+	// if the room name already exists, a room being torn down is replaced
+	if room, ok := rooms[name]; ok && room.state == roomActive {
 		return room
 	}
 	// else create a new room
-	room := newRoom()
+	room := newRoom(name)
+	room.revive()
+	if rc != nil {
+		room.applyConfig(*rc)
+	}
 	rooms[name] = room
 
-	go room.run()
+	room.startFanout()
+	// history is read by the room's own goroutine rather than under mu,
+	// joins wait in the room's queue until it is loaded
+	go func() {
+		room.loadHistory()
+		room.run()
+	}()
+	emit(roomEvent{kind: eventRoomCreated, room: name})
+	for m := range monitors {
+		if m.matches(name) {
+			m.attach(room)
+		}
+	}
 	return room
 }
 
 // upgrade a basic http connection to websocket connection
 const (
-	socketBufferSize  = 1024
+	// default capacity of a client's receive queue, see SEND_QUEUE_SIZE
 	messageBufferSize = 256
+
+	// seconds a client is asked to wait when the server is full
+	capacityRetryAfter = "30"
+
+	// unanswered keepalive probes after which the OS drops a connection
+	tcpKeepAliveProbes = 3
 )
 
-var upgrader = &websocket.Upgrader{ReadBufferSize: socketBufferSize, WriteBufferSize: socketBufferSize}
+// upgradeLimiter limits upgrade attempts per hashed IP, nil when disabled
+var upgradeLimiter *rateLimiter
+
+// roomCreateLimiter limits how many rooms each hashed IP may create, nil when disabled
+var roomCreateLimiter *rateLimiter
+
+// allowRoomCreation reports whether the request may use the named room. A
+// room that doesn't exist yet counts against the caller's creation limit;
+// when that is used up a 429 has already been written.
+func allowRoomCreation(w http.ResponseWriter, req *http.Request, name string) bool {
+	if ok, wait := roomCreationAllowed(ipKey(clientIP(req)), name); !ok {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		http.Error(w, "Too many rooms created", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// roomCreationAllowed reports whether the hashed IP ip may use the named
+// room, counting it against ip's creation limit when it doesn't exist yet,
+// and otherwise how long until it may
+func roomCreationAllowed(ip, name string) (bool, time.Duration) {
+	if roomCreateLimiter == nil {
+		return true, 0
+	}
+	if _, ok := lookupRoom(name); ok {
+		return true, 0
+	}
+	return roomCreateLimiter.allow(ip)
+}
+
+// botLimiter limits messages from bots per hashed IP, nil when disabled
+var botLimiter *rateLimiter
+
+// wire format versions clients may ask for with Sec-WebSocket-Protocol,
+// the newest first so it wins when a client offers several
+var subprotocols = []string{protoSubprotocol, "chat.v2", "chat.v1"}
 
-func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+// writeBufferPool shares write buffers between connections: a connection
+// only holds one while writing a message and returns it afterwards, so idle
+// connections hold none. sync.Pool is safe for concurrent use, and each
+// connection still has a single writer, write(), as gorilla requires.
+var writeBufferPool sync.Pool
+
+// upgrades by negotiated subprotocol, "none", and unsupported offers
+// that were rejected or fell back to no subprotocol
+var subprotocolMetric = expvar.NewMap("subprotocols")
+
+// upgrader's buffer settings are applied from the config in main()
+var upgrader = &websocket.Upgrader{
+	Subprotocols: subprotocols,
+	CheckOrigin:  checkOrigin,
+}
+
+// supportedSubprotocol reports whether a client asking for subprotocols
+// offered at least one we speak, asking for none is fine too
+func supportedSubprotocol(req *http.Request) bool {
+	requested := websocket.Subprotocols(req)
+	if len(requested) == 0 {
+		return true
+	}
+	for _, p := range requested {
+		if slices.Contains(subprotocols, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// setKeepAlive turns on TCP keepalive for the connection under a socket, so
+// the OS notices dead peers even if the WebSocket pings go unnoticed
+func setKeepAlive(socket *websocket.Conn) {
+	tcp, ok := socket.NetConn().(*net.TCPConn)
+	if !ok || cfg.tcpKeepAlive <= 0 {
+		return
+	}
+	err := tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     cfg.tcpKeepAlive,
+		Interval: cfg.tcpKeepAlive,
+		Count:    tcpKeepAliveProbes,
+	})
+	if err != nil {
+		log.Println("Setting TCP keepalive failed:", err)
+	}
+}
+
+// isModerator reports whether the request carries the moderator key as ?mod=
+func isModerator(req *http.Request) bool {
+	key := req.URL.Query().Get("mod")
+	return cfg.moderatorKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(cfg.moderatorKey)) == 1
+}
+
+// isBot reports whether the client identifies itself as a bot with ?bot=1
+func isBot(req *http.Request) bool {
+	bot, _ := strconv.ParseBool(req.URL.Query().Get("bot"))
+	return bot
+}
+
+// roomHandler serves /room?room=<name>, upgrading to a WebSocket that joins
+// the room. Every check runs before the room is touched, it is only created
+// once the client has been let in.
+func roomHandler(w http.ResponseWriter, req *http.Request) {
 
 	roomName := req.URL.Query().Get("room")
 	if roomName == "" {
 		http.Error(w, "Missing room parameter", http.StatusBadRequest)
 		return
 	}
+	if !validRoomName(roomName) {
+		http.Error(w, "Invalid room name", http.StatusBadRequest)
+		return
+	}
+	// send new connections to another instance while this one drains
+	if draining.Load() {
+		w.Header().Set("Retry-After", capacityRetryAfter)
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 
-	realRoom := getRoom(roomName)
+	rawIP := clientIP(req)
+	ip := ipKey(rawIP)
+
+	// blunt reconnect storms before doing any work for the upgrade
+	if upgradeLimiter != nil && !containsIP(cfg.upgradeRateAllow, rawIP) {
+		if ok, wait := upgradeLimiter.allow(ip); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(w, "Too many connection attempts", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if !supportedSubprotocol(req) {
+		offered := strings.Join(websocket.Subprotocols(req), ", ")
+		if cfg.subprotocolPolicy == "reject" {
+			subprotocolMetric.Add("rejected", 1)
+			upgradeLog.printf(roomName, "rejected upgrade offering only unsupported subprotocols %q", offered)
+			http.Error(w, "Unsupported subprotocol, supported: "+strings.Join(subprotocols, ", "), http.StatusBadRequest)
+			return
+		}
+		// the handshake completes without a subprotocol and the client decides
+		subprotocolMetric.Add("fallback", 1)
+		upgradeLog.printf(roomName, "no supported subprotocol in %q, connecting without one", offered)
+	}
+
+	name, ok := clientName(req)
+	if !ok {
+		http.Error(w, "A valid name parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// clients that can set headers are checked before upgrading, browsers
+	// send an "auth" frame once connected
+	passwordHash := roomPasswordHash(roomName)
+	if isModerator(req) {
+		passwordHash = nil
+	}
+	if password := req.Header.Get(roomPasswordHeader); password != "" {
+		if !passwordMatches(passwordHash, password) {
+			http.Error(w, "Invalid room password", http.StatusUnauthorized)
+			return
+		}
+		passwordHash = nil
+	}
+
+	if !allowRoomCreation(w, req, roomName) {
+		return
+	}
+
+	// reserve a connection slot before upgrading, it is released once the client has left
+	if n := connections.Add(1); cfg.maxConnections > 0 && n > int64(cfg.maxConnections) {
+		connections.Add(-1)
+		w.Header().Set("Retry-After", capacityRetryAfter)
+		http.Error(w, "Server is at capacity", http.StatusServiceUnavailable)
+		return
+	}
+	defer connections.Add(-1)
 
 	socket, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Println("Upgrade error:", err)
+		upgradeLog.printf(roomName, "Upgrade error from %s: %v", ip, err)
 		return
 	}
+	setKeepAlive(socket)
+	// hard cap on frame size, the connection is closed if a client exceeds it
+	socket.SetReadLimit(cfg.maxMessageBytes)
+	if p := socket.Subprotocol(); p != "" {
+		subprotocolMetric.Add(p, 1)
+	} else {
+		subprotocolMetric.Add("none", 1)
+	}
+
 	client := &client{
-		socket:  socket,
-		room:    realRoom,
-		receive: make(chan []byte, messageBufferSize),
-		name:    fmt.Sprintf("user%d", rand.Intn(1000)),
+		transport: newWSTransport(socket),
+		receive:   make(chan []byte, sendQueueSize(socket.Subprotocol(), isBot(req), false)),
+		done:      make(chan struct{}),
+		name:      name,
+		color:     nameColor(name),
+		avatar:    avatarURL(name, req.URL.Query().Get("email")),
+		session:   rand.Text(),
+		connected: time.Now(),
+
+		moderator: isModerator(req),
+		bot:       isBot(req),
+		protocol:  socket.Subprotocol(),
+		version:   wireVersion(socket.Subprotocol(), req.URL.Query().Get("v")),
+		binary:    socket.Subprotocol() == protoSubprotocol,
+		ip:        ip,
+		origin:    req.Header.Get("Origin"),
+		lang:      parseLang(req.URL.Query().Get("lang")),
+		loc:       parseTimezone(req.URL.Query().Get("tz")),
 	}
-	realRoom.join <- client
+	// v1 frames are single legacy objects and protobuf frames single
+	// envelopes, arrays would break those clients
+	client.batch = cfg.batchWindow > 0 && client.version == wireV2 && !client.binary && req.URL.Query().Get("batch") == "1"
+	if passwordHash != nil && !client.authenticate(passwordHash) {
+		client.refuse(errInvalidPassword, "invalid_password")
+		return
+	}
+	realRoom := getRoom(roomName)
+	client.room = realRoom
+	if !realRoom.enter(client) {
+		// the room was closed while upgrading
+		client.transport.SetWriteDeadline(time.Now().Add(cfg.writeWait))
+		client.transport.WriteClose(websocket.CloseGoingAway, "closed")
+		client.transport.Close()
+		return
+	}
+	recordConnection(req, roomName, rawIP)
 
-	defer func() {
-		realRoom.leave <- client
-	}()
+	defer realRoom.exit(client)
 	go client.write()
 	client.read()
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"maps"
+)
+
+// RoomStore is implemented by stores that also keep room configuration, so
+// rooms set up by moderators come back after a restart. Membership is not
+// kept, clients reconnect on their own.
+type RoomStore interface {
+	// SaveRoom stores the configuration of a room, replacing the previous one
+	SaveRoom(rc roomConfig) error
+
+	// Rooms returns the configuration of every stored room
+	Rooms() ([]roomConfig, error)
+}
+
+// roomConfig is the part of a room that outlives the process
+type roomConfig struct {
+	Name        string `json:"name"`
+	HistorySize int    `json:"historySize"`
+	Paused      bool   `json:"paused"`
+	MOTD        string `json:"motd,omitempty"`
+
+	// commands allowed by /commands, null for all of them
+	Commands []string `json:"commands"`
+
+	// client types restricted with /types, to "moderators" or "none"
+	Types map[string]string `json:"types,omitempty"`
+
+	// bcrypt hash, never the password itself
+	PasswordHash []byte `json:"passwordHash,omitempty"`
+}
+
+// config snapshots the room's configuration, called from run()
+func (r *room) config() roomConfig {
+	return roomConfig{Name: r.name, HistorySize: r.historySize, Paused: r.paused, MOTD: r.motd, Commands: r.commandList(), Types: maps.Clone(r.types), PasswordHash: r.passwordHash}
+}
+
+// applyConfig restores a configuration taken by config, called from run()
+// or before the room runs
+func (r *room) applyConfig(rc roomConfig) {
+	r.historySize = rc.HistorySize
+	r.paused = rc.Paused
+	r.motd = rc.MOTD
+	r.setCommands(rc.Commands)
+	r.types = nil
+	for typ, policy := range rc.Types {
+		r.setTypePolicy(typ, policy)
+	}
+	r.passwordHash = rc.PasswordHash
+}
+
+// room configuration changes are saved in order by a background goroutine,
+// so a slow store never holds up a room
+var roomConfigQueue = make(chan roomConfig, 64)
+
+// saveRoomConfig queues the room's configuration for the store, called from
+// run() whenever a moderator changes it
+func (r *room) saveRoomConfig() {
+	if _, ok := store.(RoomStore); !ok {
+		return
+	}
+	select {
+	case roomConfigQueue <- r.config():
+	default:
+		log.Printf("room config queue full, not saving room %q", r.name)
+	}
+}
+
+// writeRoomConfigs saves queued room configurations until the process exits
+func writeRoomConfigs(rs RoomStore) {
+	for rc := range roomConfigQueue {
+		err := storeBreaker.call(func() error {
+			return rs.SaveRoom(rc)
+		})
+		if err != nil && !errors.Is(err, errBreakerOpen) {
+			log.Printf("Saving room %q failed: %v", rc.Name, err)
+		}
+	}
+}
+
+// restoreRooms recreates the stored rooms with their configuration and
+// starts saving changes, when the store keeps rooms
+func restoreRooms() error {
+	rs, ok := store.(RoomStore)
+	if !ok {
+		return nil
+	}
+	configs, err := rs.Rooms()
+	if err != nil {
+		return err
+	}
+	for _, rc := range configs {
+		if !validRoomName(rc.Name) {
+			log.Printf("skipping stored room with invalid name %q", rc.Name)
+			continue
+		}
+		openRoom(rc.Name, &rc)
+	}
+	if len(configs) > 0 {
+		log.Printf("restored %d rooms", len(configs))
+	}
+	go writeRoomConfigs(rs)
+	return nil
+}
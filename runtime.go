@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// goroutines this server starts per room and per client, compared against
+// runtime.NumGoroutine() they show where a leak comes from
+var (
+	roomLoops    atomic.Int64
+	clientWrites atomic.Int64
+)
+
+// runtimeStats is the body of GET /debug/runtime
+type runtimeStats struct {
+	Goroutines int `json:"goroutines"`
+
+	// running room loops and client write() goroutines; each client also
+	// has its read() on the goroutine serving its upgrade request
+	RoomLoops    int64 `json:"roomLoops"`
+	ClientWrites int64 `json:"clientWrites"`
+	Rooms        int   `json:"rooms"`
+	Connections  int64 `json:"connections"`
+
+	// client receive queues grouped by size, see SEND_QUEUE_SIZES
+	SendQueues []sendQueueStats `json:"sendQueues"`
+
+	Memory memoryStats `json:"memory"`
+	GC     gcStats     `json:"gc"`
+}
+
+// memoryStats are in bytes, except HeapObjects
+type memoryStats struct {
+	Alloc       uint64 `json:"alloc"`
+	TotalAlloc  uint64 `json:"totalAlloc"`
+	Sys         uint64 `json:"sys"`
+	HeapAlloc   uint64 `json:"heapAlloc"`
+	HeapInuse   uint64 `json:"heapInuse"`
+	HeapObjects uint64 `json:"heapObjects"`
+	StackInuse  uint64 `json:"stackInuse"`
+}
+
+type gcStats struct {
+	NumGC uint32 `json:"numGC"`
+
+	// pauses in nanoseconds, last is unix millis, 0 before the first GC
+	PauseTotal int64   `json:"pauseTotal"`
+	LastPause  uint64  `json:"lastPause"`
+	Last       int64   `json:"last"`
+	CPU        float64 `json:"cpuFraction"`
+}
+
+// runtimeHandler serves GET /debug/runtime for spotting goroutine and memory
+// leaks without pprof, behind ADMIN_TOKEN like /monitor
+func runtimeHandler(w http.ResponseWriter, req *http.Request) {
+	if cfg.adminToken == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	mu.Lock()
+	n := len(rooms)
+	mu.Unlock()
+
+	stats := runtimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		RoomLoops:    roomLoops.Load(),
+		ClientWrites: clientWrites.Load(),
+		Rooms:        n,
+		Connections:  connections.Load(),
+		SendQueues:   collectSendQueues(),
+		Memory: memoryStats{
+			Alloc:       m.Alloc,
+			TotalAlloc:  m.TotalAlloc,
+			Sys:         m.Sys,
+			HeapAlloc:   m.HeapAlloc,
+			HeapInuse:   m.HeapInuse,
+			HeapObjects: m.HeapObjects,
+			StackInuse:  m.StackInuse,
+		},
+		GC: gcStats{
+			NumGC:      m.NumGC,
+			PauseTotal: int64(m.PauseTotalNs),
+			CPU:        m.GCCPUFraction,
+		},
+	}
+	if m.NumGC > 0 {
+		stats.GC.LastPause = m.PauseNs[(m.NumGC+255)%256]
+		stats.GC.Last = time.Unix(0, int64(m.LastGC)).UnixMilli()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// scheduledMessage is a chat message held by the room until its send time
+type scheduledMessage struct {
+	id    int
+	owner *client
+	name  string
+	text  string
+	timer *time.Timer
+
+	// identity of the owner, the limit and cancelling go by it so they
+	// carry over reconnects
+	author string
+
+	// posted as an ephemeral message, see envelope.Ephemeral
+	ephemeral bool
+}
+
+// schedule handles {"type":"schedule","at":<unixMillis>,"message":"..."}
+func (r *room) schedule(e *envelope) {
+	at := time.UnixMilli(e.At)
+	delay := time.Until(at)
+
+	switch {
+	case strings.TrimSpace(e.Message) == "":
+		r.reject(e.from, errInvalidMessage, "schedule_empty")
+		return
+	case strings.HasPrefix(e.Message, "/"):
+		r.reject(e.from, errInvalidMessage, "schedule_command")
+		return
+	case delay <= 0:
+		r.reject(e.from, errInvalidMessage, "schedule_past")
+		return
+	case delay > cfg.maxScheduleDelay:
+		r.reject(e.from, errInvalidMessage, "schedule_too_far", cfg.maxScheduleDelay)
+		return
+	}
+
+	if cfg.maxScheduledPerRoom > 0 && len(r.scheduled) >= cfg.maxScheduledPerRoom {
+		r.reject(e.from, errLimitReached, "schedule_room_limit", len(r.scheduled))
+		return
+	}
+	pending := 0
+	for _, sm := range r.scheduled {
+		if sm.author == e.from.identity {
+			pending++
+		}
+	}
+	if pending >= cfg.maxScheduledPerUser {
+		r.reject(e.from, errLimitReached, "schedule_limit", pending)
+		return
+	}
+
+	r.lastScheduled++
+	sm := &scheduledMessage{
+		id:    r.lastScheduled,
+		owner: e.from,
+		name:  e.Name,
+		text:  e.Message,
+
+		author:    e.from.identity,
+		ephemeral: e.Ephemeral,
+	}
+	sm.timer = time.AfterFunc(delay, func() {
+		r.submit(&envelope{Type: "sendscheduled", ID: sm.id})
+	})
+	r.scheduled[sm.id] = sm
+
+	r.send(e.from, &envelope{Type: "scheduled", ID: sm.id, At: e.At, Message: sm.text})
+}
+
+// unschedule handles {"type":"unschedule","id":N}, cancelling a pending message
+func (r *room) unschedule(e *envelope) {
+	sm, ok := r.scheduled[e.ID]
+	if !ok || sm.author != e.from.identity {
+		r.reject(e.from, errNotFound, "schedule_not_found")
+		return
+	}
+	sm.timer.Stop()
+	delete(r.scheduled, sm.id)
+
+	r.send(e.from, &envelope{Type: "unscheduled", ID: sm.id})
+}
+
+// sendScheduled broadcasts a scheduled message once its timer fires
+func (r *room) sendScheduled(id int) {
+	sm, ok := r.scheduled[id]
+	if !ok {
+		// cancelled after the timer had already fired
+		return
+	}
+	delete(r.scheduled, id)
+
+	e := newMessage(sm.name, sm.text)
+	e.Bot = sm.owner.bot
+	e.Avatar = sm.owner.avatar
+	e.Ephemeral = sm.ephemeral
+	e.from = sm.owner
+	r.handle(e)
+}
+
+// cancelScheduled drops every pending message of a client that has left
+func (r *room) cancelScheduled(c *client) {
+	for id, sm := range r.scheduled {
+		if sm.owner == c {
+			sm.timer.Stop()
+			delete(r.scheduled, id)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// the per-user limit follows the user across reconnects, and the room as a
+// whole has a limit of its own
+func TestScheduleLimits(t *testing.T) {
+	withConfig(t, func(c *config) {
+		c.maxScheduledPerUser = 2
+		c.maxScheduledPerRoom = 3
+		c.scheduleAfterLeave = true
+	})
+	r := newTestRoom(t, "schedule-limits")
+	at := time.Now().Add(time.Hour).UnixMilli()
+	schedule := func(c *testClient) *envelope {
+		c.send(fmt.Sprintf(`{"type":"schedule","at":%d,"message":"later"}`, at))
+		for {
+			if e := c.next(); e.Type == "scheduled" || e.Type == "error" {
+				return e
+			}
+		}
+	}
+
+	alice := joinTestRoom(t, r, "alice")
+	first := schedule(alice)
+	schedule(alice)
+	alice.leave()
+	<-alice.done
+
+	alice = joinTestRoom(t, r, "alice")
+	if e := schedule(alice); e.Code != errLimitReached {
+		t.Fatalf("third message after reconnecting got %+v, want %s", e, errLimitReached)
+	}
+	alice.send(fmt.Sprintf(`{"type":"unschedule","id":%d}`, first.ID))
+	alice.expect("unscheduled")
+	schedule(alice)
+
+	bob := joinTestRoom(t, r, "bob")
+	if e := schedule(bob); e.Type != "scheduled" {
+		t.Fatalf("bob got %+v, want his message scheduled", e)
+	}
+	if e := schedule(bob); e.Code != errLimitReached {
+		t.Fatalf("bob got %+v past the room's limit, want %s", e, errLimitReached)
+	}
+}
+
+// a scheduled message going out is not activity of its sender, an away
+// client stays away
+func TestScheduledMessageKeepsAway(t *testing.T) {
+	r := newTestRoom(t, "schedule-away")
+	alice := joinTestRoom(t, r, "alice")
+	alice.send(fmt.Sprintf(`{"type":"schedule","at":%d,"message":"later"}`, time.Now().Add(300*time.Millisecond).UnixMilli()))
+	alice.expect("scheduled")
+	r.do(func() {
+		r.setStatus(alice.client, statusAway)
+	})
+	alice.expect("presence")
+
+	if e := alice.expect("message"); e.Message != "later" {
+		t.Fatalf("got %+v, want the scheduled message", e)
+	}
+	var status string
+	r.do(func() {
+		status = alice.status
+	})
+	if status != statusAway {
+		t.Fatalf("alice is %s after the scheduled message went out, want %s", status, statusAway)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseSendQueueSizes parses SEND_QUEUE_SIZES, comma separated entries of a
+// client type ("bot", "monitor") or negotiated subprotocol, '=' and a queue
+// size: "bot=1024,monitor=4096,chat.v1=64"
+func parseSendQueueSizes(s string) (map[string]int, error) {
+	sizes := make(map[string]int)
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || key == "" || err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		sizes[key] = n
+	}
+	return sizes, nil
+}
+
+// sendQueueSize picks the capacity of a client's receive queue: its type
+// first, as slow consumers like bots and monitors need the most headroom,
+// then its subprotocol, then SEND_QUEUE_SIZE
+func sendQueueSize(protocol string, bot, monitor bool) int {
+	if n, ok := cfg.sendQueueSizes["monitor"]; ok && monitor {
+		return n
+	}
+	if n, ok := cfg.sendQueueSizes["bot"]; ok && bot {
+		return n
+	}
+	if n, ok := cfg.sendQueueSizes[protocol]; ok && protocol != "" {
+		return n
+	}
+	return cfg.sendQueueSize
+}
+
+// sendQueueStats summarises the receive queues of the clients sharing one
+// queue size, part of GET /debug/runtime
+type sendQueueStats struct {
+	Size    int `json:"size"`
+	Clients int `json:"clients"`
+
+	// messages waiting across these clients, the longest single queue and
+	// how many queues are full right now
+	Queued   int `json:"queued"`
+	MaxDepth int `json:"maxDepth"`
+	Full     int `json:"full"`
+}
+
+// collectSendQueues groups every connected client's queue by its size
+func collectSendQueues() []sendQueueStats {
+	bySize := make(map[int]*sendQueueStats)
+	for _, r := range allRooms() {
+		r.do(func() {
+			for c := range r.clients {
+				size, depth := cap(c.receive), len(c.receive)
+				s, ok := bySize[size]
+				if !ok {
+					s = &sendQueueStats{Size: size}
+					bySize[size] = s
+				}
+				s.Clients++
+				s.Queued += depth
+				s.MaxDepth = max(s.MaxDepth, depth)
+				if depth == size {
+					s.Full++
+				}
+			}
+		})
+	}
+
+	list := make([]sendQueueStats, 0, len(bySize))
+	for _, s := range bySize {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Size < list[j].Size })
+	return list
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// draining is set once a graceful shutdown begins: /readyz turns 503 and
+// new WebSocket upgrades are refused so traffic moves to other instances
+var draining atomic.Bool
+
+// readyzHandler tells load balancers whether to send new connections here
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready"))
+}
+
+// shutdown stops the server. With SHUTDOWN_MODE=drain it first reports not
+// ready for SHUTDOWN_READY_DELAY, stops accepting requests, tells every room
+// the server is restarting and gives clients SHUTDOWN_RECONNECT_WAIT to
+// reconnect elsewhere, then disconnects the rest within SHUTDOWN_GRACE.
+// A hard stop closes everything at once. Queued saves are flushed either way.
+func shutdown(server *http.Server) {
+	defer stopStoreWriter()
+
+	if cfg.shutdownMode == "hard" {
+		server.Close()
+		closeClients(0)
+		return
+	}
+
+	draining.Store(true)
+	if cfg.shutdownReadyDelay > 0 {
+		log.Printf("draining: not ready, waiting %v for load balancers to notice", cfg.shutdownReadyDelay)
+		time.Sleep(cfg.shutdownReadyDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownHTTPTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Shutdown error:", err)
+	}
+
+	if cfg.shutdownReconnectWait > 0 {
+		announceAll("server_restarting")
+		waitForClients(cfg.shutdownReconnectWait)
+	}
+	closeClients(cfg.shutdownGrace)
+}
+
+// announceAll broadcasts a system message to every room
+func announceAll(key string, args ...any) {
+	for _, r := range allRooms() {
+		r.do(func() {
+			r.announce(key, args...)
+		})
+	}
+}
+
+// waitForClients waits until every connection is closed or timeout passes
+func waitForClients(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for connections.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := connections.Load(); n > 0 {
+		log.Printf("draining: %d connections left after %v", n, timeout)
+	}
+}
+
+// allRooms returns a snapshot of the open rooms
+func allRooms() []*room {
+	mu.Lock()
+	defer mu.Unlock()
+	all := make([]*room, 0, len(rooms))
+	for _, r := range rooms {
+		all = append(all, r)
+	}
+	return all
+}
+
+// closeClients disconnects every client on shutdown. Each client is removed
+// from its room and its write() goroutine left to drain the queued messages
+// and the final notice; sockets still busy after grace are closed outright.
+func closeClients(grace time.Duration) {
+	var clients []*client
+	for _, r := range allRooms() {
+		r.do(func() {
+			for c := range r.clients {
+				r.disconnect(c, "shutdown", websocket.CloseGoingAway)
+				clients = append(clients, c)
+			}
+		})
+	}
+
+	timeout := time.After(grace)
+	for i, c := range clients {
+		select {
+		case <-c.done:
+		case <-timeout:
+			log.Printf("shutdown grace expired, closing %d connections", len(clients)-i)
+			for _, c := range clients[i:] {
+				c.transport.Close()
+			}
+			return
+		}
+	}
+}
@@ -1,47 +1,135 @@
-const params = new URLSearchParams(window.location.search);
-const room = params.get("room");
+// the server renders the room and the socket URL into the page
+const room = document.body.dataset.room;
 
 if (!room) {
   alert("No room specified. Redirecting to homepage...");
-  window.location.href = "/";
+  window.location.href = document.body.dataset.basePath + "/";
 }
 
-const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
-const socket = new WebSocket(`${protocol}//${location.host}/room?room=${room}`);
+let socket;
 
-socket.onmessage = (event) => {
-  try {
-    const data = JSON.parse(event.data);
+// set when the server asks us to come back later, e.g. before a restart
+let reconnectHint = null;
 
-    // Create the container div
-    const msgContainer = document.createElement("div");
-    msgContainer.classList.add("message-container");
+function connect() {
+  socket = new WebSocket(document.body.dataset.wsUrl);
 
-    // Create the username div
-    const usernameDiv = document.createElement("div");
-    usernameDiv.classList.add("username");
-    usernameDiv.textContent = data.name;
+  socket.onmessage = (event) => {
+    try {
+      const data = JSON.parse(event.data);
 
-    // Create the message div
-    const messageDiv = document.createElement("div");
-    messageDiv.classList.add("message");
-    messageDiv.textContent = data.message;
+      // with batching the server may send several messages as one JSON array
+      for (const message of Array.isArray(data) ? data : [data]) {
+        if (message.type === "reconnect") {
+          reconnectHint = message;
+          continue;
+        }
+        if (message.type === "room") {
+          followRename(message.room);
+          continue;
+        }
+        renderMessage(message);
+      }
+    } catch (err) {
+      console.error("Invalid JSON received:", event.data);
+    }
+  };
+
+  // reconnect only when invited to, spreading clients out as the server asks
+  socket.onclose = () => {
+    if (!reconnectHint) {
+      return;
+    }
+    let delay = reconnectHint.after || 0;
+    if (reconnectHint.jitter) {
+      delay += Math.random() * delay;
+    }
+    reconnectHint = null;
+    setTimeout(connect, delay);
+  };
+}
 
-    // Append username and message in correct order
-    msgContainer.appendChild(usernameDiv);
-    msgContainer.appendChild(messageDiv);
+connect();
 
-    // Append the whole message container to the messages div
-    document.getElementById("messages").appendChild(msgContainer);
+// an admin renamed the room: show the new name and use it when reconnecting
+function followRename(name) {
+  const ws = new URL(document.body.dataset.wsUrl);
+  ws.searchParams.set("room", name);
+  document.body.dataset.wsUrl = ws.toString();
+  document.body.dataset.room = name;
+  history.replaceState(null, "", `${document.body.dataset.basePath}/chat/${encodeURIComponent(name)}${location.hash}`);
+}
+
+function renderMessage(data) {
+  // only chat messages and server notices are rendered for now
+  if (data.type === "system" || data.type === "error" || data.type === "closing") {
+    data.name = "system";
+  } else if (data.type && data.type !== "message") {
+    return;
+  }
 
-    // Auto-scroll
-    const messagesDiv = document.getElementById("messages");
-    messagesDiv.scrollTop = messagesDiv.scrollHeight;
+  // Create the container div
+  const msgContainer = document.createElement("div");
+  msgContainer.classList.add("message-container");
+
+  // anchor for permalinks like /chat?room=foo#msg-42
+  if (data.seq) {
+    msgContainer.id = `msg-${data.seq}`;
+  }
+
+  // Create the username div
+  const usernameDiv = document.createElement("div");
+  usernameDiv.classList.add("username");
+  usernameDiv.textContent = data.name;
+
+  if (data.avatar) {
+    const avatar = document.createElement("img");
+    avatar.classList.add("avatar");
+    avatar.src = data.avatar;
+    avatar.alt = "";
+    usernameDiv.prepend(avatar);
+  }
 
-  } catch (err) {
-    console.error("Invalid JSON received:", event.data);
+  // automated participants are tagged so people can tell them apart
+  if (data.bot) {
+    const botTag = document.createElement("span");
+    botTag.classList.add("bot-tag");
+    botTag.textContent = "BOT";
+    usernameDiv.appendChild(botTag);
   }
-};
+
+  // ephemeral messages vanish on reload, say so
+  if (data.ephemeral) {
+    const ephemeralTag = document.createElement("span");
+    ephemeralTag.classList.add("ephemeral-tag");
+    ephemeralTag.textContent = "NOT SAVED";
+    usernameDiv.appendChild(ephemeralTag);
+  }
+
+  // Create the message div
+  const messageDiv = document.createElement("div");
+  messageDiv.classList.add("message");
+  // the server sanitizes html, it only ever contains the tags it adds itself
+  if (data.html) {
+    messageDiv.innerHTML = data.html;
+  } else {
+    messageDiv.textContent = data.message;
+  }
+  if (data.format === "shout" || data.format === "code") {
+    messageDiv.classList.add(`message-${data.format}`);
+  }
+
+  // Append username and message in correct order
+  msgContainer.appendChild(usernameDiv);
+  msgContainer.appendChild(messageDiv);
+
+  // Append the whole message container to the messages div
+  document.getElementById("messages").appendChild(msgContainer);
+
+  // Auto-scroll
+  const messagesDiv = document.getElementById("messages");
+  messagesDiv.scrollTop = messagesDiv.scrollHeight;
+}
 
 function sendMessage() {
   const input = document.getElementById("msg");
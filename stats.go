@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// stats are computed over at most this many of a room's latest stored messages
+	statsMessageLimit = 5000
+
+	// number of users listed in the per-user message counts
+	statsTopUsers = 20
+
+	// computed stats are reused for this long
+	statsCacheTTL = 30 * time.Second
+)
+
+// userCount is the number of messages a user sent
+type userCount struct {
+	Name     string `json:"name"`
+	Messages int    `json:"messages"`
+}
+
+// roomStats is the body of GET /rooms/{name}/stats
+type roomStats struct {
+	Room     string      `json:"room"`
+	Messages int         `json:"messages"`
+	Users    []userCount `json:"users"`
+
+	// messages sent in each hour of the day, UTC
+	Hours [24]int `json:"hours"`
+}
+
+type cachedStats struct {
+	body    []byte
+	expires time.Time
+}
+
+var (
+	statsMu    sync.Mutex
+	statsCache = make(map[string]cachedStats)
+)
+
+// statsHandler serves GET /rooms/{name}/stats, aggregated from the stored
+// history so it needs a message store
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Message store not configured", http.StatusNotFound)
+		return
+	}
+	name := r.PathValue("name")
+	if !checkRoomPassword(name, r) {
+		http.Error(w, "Invalid room password", http.StatusUnauthorized)
+		return
+	}
+
+	statsMu.Lock()
+	cached, ok := statsCache[name]
+	statsMu.Unlock()
+	if !ok || time.Now().After(cached.expires) {
+		var history []*envelope
+		err := storeBreaker.call(func() error {
+			var err error
+			history, err = store.Recent(name, statsMessageLimit)
+			return err
+		})
+		if err != nil {
+			log.Println("Loading history for stats failed:", err)
+			http.Error(w, "Message store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := json.Marshal(computeStats(name, history))
+		if err != nil {
+			http.Error(w, "Encoding failed", http.StatusInternalServerError)
+			return
+		}
+		cached = cachedStats{body: body, expires: time.Now().Add(statsCacheTTL)}
+
+		statsMu.Lock()
+		// drop expired entries so rooms that are never asked for again don't linger
+		for room, c := range statsCache {
+			if time.Now().After(c.expires) {
+				delete(statsCache, room)
+			}
+		}
+		statsCache[name] = cached
+		statsMu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(cached.body)
+}
+
+// computeStats aggregates a room's chat messages
+func computeStats(room string, history []*envelope) *roomStats {
+	stats := &roomStats{Room: room, Users: []userCount{}}
+	perUser := make(map[string]int)
+	for _, e := range history {
+		if e.Type != "message" || e.Deleted {
+			continue
+		}
+		stats.Messages++
+		perUser[e.Name]++
+		stats.Hours[time.UnixMilli(e.Time).UTC().Hour()]++
+	}
+
+	for name, n := range perUser {
+		stats.Users = append(stats.Users, userCount{Name: name, Messages: n})
+	}
+	sort.Slice(stats.Users, func(i, j int) bool {
+		if stats.Users[i].Messages != stats.Users[j].Messages {
+			return stats.Users[i].Messages > stats.Users[j].Messages
+		}
+		return stats.Users[i].Name < stats.Users[j].Name
+	})
+	if len(stats.Users) > statsTopUsers {
+		stats.Users = stats.Users[:statsTopUsers]
+	}
+	return stats
+}
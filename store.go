@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"time"
+)
+
+// MessageStore persists chat history outside of the process, e.g. in a database
+type MessageStore interface {
+	// Save appends a batch of chat messages, each tagged with its room;
+	// "edit" and "delete" envelopes record changes to an earlier message,
+	// "poll", "vote" and "closepoll" ones the life of a poll
+	Save(batch []storedMessage) error
+
+	// Recent returns up to n of the latest messages of a room, oldest first,
+	// with their edits and deletes applied
+	Recent(room string, n int) ([]*envelope, error)
+
+	// Polls returns the polls created among a room's latest n messages,
+	// oldest first, with their votes and whether they were closed
+	Polls(room string, n int) ([]*poll, error)
+}
+
+// storedMessage is a chat message together with the room it was sent in.
+// Without a message it asks the writer to rename room to renameTo, in order
+// with the messages queued before it.
+type storedMessage struct {
+	room string
+	e    *envelope
+
+	renameTo string
+}
+
+// store is the configured persistence backend, nil keeps history in memory only
+var store MessageStore
+
+// storeBreaker stops calling a failing store so chat keeps working from memory
+var storeBreaker *circuitBreaker
+
+// messages are handed to a background writer so broadcasting never waits on the store
+var (
+	storeQueue       chan storedMessage
+	storeWriterStop  = make(chan struct{})
+	storeWriterDone  = make(chan struct{})
+	storeQueueMetric = expvar.NewMap("store_queue")
+	droppedSaves     expvar.Int
+	savedMessages    expvar.Int
+)
+
+func init() {
+	storeQueueMetric.Set("dropped", &droppedSaves)
+	storeQueueMetric.Set("saved", &savedMessages)
+	storeQueueMetric.Set("depth", expvar.Func(func() any {
+		return len(storeQueue)
+	}))
+}
+
+// loadHistory fills a new room's history from the store, so replay and seq
+// numbers carry on across restarts; called by the room's goroutine before
+// it runs
+func (r *room) loadHistory() {
+	if store == nil {
+		return
+	}
+	var history []*envelope
+	var polls []*poll
+	err := storeBreaker.call(func() error {
+		var err error
+		// at least the last message, for its seq
+		if history, err = store.Recent(r.name, max(r.historySize, 1)); err != nil {
+			return err
+		}
+		polls, err = store.Polls(r.name, max(r.historySize, 1))
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, errBreakerOpen) {
+			log.Printf("Loading history of room %q failed: %v", r.name, err)
+		}
+		return
+	}
+	if n := len(history); n > 0 {
+		r.seq = history[n-1].Seq
+	}
+	r.history = history
+	r.trimHistory(r.historySize)
+	r.restorePolls(polls)
+}
+
+// saveMessage queues a chat message, an edit or delete of one, or a poll
+// record for persistence if a store is configured
+func saveMessage(room string, e *envelope) {
+	if store == nil {
+		return
+	}
+
+	// the room keeps editing its own copy, the writer gets a snapshot
+	snapshot := *e
+	m := storedMessage{room: room, e: &snapshot}
+
+	if cfg.storeQueuePolicy == "drop" {
+		select {
+		case storeQueue <- m:
+		default:
+			droppedSaves.Add(1)
+		}
+		return
+	}
+
+	select {
+	case storeQueue <- m:
+	case <-storeWriterDone:
+		droppedSaves.Add(1)
+	}
+}
+
+// startStoreWriter runs the goroutine that batches queued messages into the store
+func startStoreWriter() {
+	storeQueue = make(chan storedMessage, cfg.storeQueueSize)
+	go writeStore()
+}
+
+// stopStoreWriter flushes every queued message and waits for the writer to exit
+func stopStoreWriter() {
+	if storeQueue == nil {
+		return
+	}
+	close(storeWriterStop)
+	<-storeWriterDone
+}
+
+func writeStore() {
+	defer close(storeWriterDone)
+
+	ticker := time.NewTicker(cfg.storeFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]storedMessage, 0, cfg.storeBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := storeBreaker.call(func() error {
+			return store.Save(batch)
+		})
+		switch {
+		case err == nil:
+			savedMessages.Add(int64(len(batch)))
+		case errors.Is(err, errBreakerOpen):
+			droppedSaves.Add(int64(len(batch)))
+		default:
+			droppedSaves.Add(int64(len(batch)))
+			log.Println("Saving messages failed:", err)
+		}
+		batch = batch[:0]
+	}
+
+	add := func(m storedMessage) {
+		if m.renameTo != "" {
+			// messages saved under the old name go first
+			flush()
+			renameStoredRoom(m.room, m.renameTo)
+			return
+		}
+		batch = append(batch, m)
+		if len(batch) >= cfg.storeBatchSize {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case m := <-storeQueue:
+			add(m)
+		case <-ticker.C:
+			flush()
+		case <-storeWriterStop:
+			// drain whatever is still queued before exiting
+			for {
+				select {
+				case m := <-storeQueue:
+					add(m)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import "github.com/gorilla/websocket"
+
+// roomState is a room's lifecycle stage, guarded by mu
+type roomState int
+
+const (
+	// handed out by getRoom and listed
+	roomActive roomState = iota
+	// being torn down: still in rooms but never handed out again, a new
+	// room of the same name replaces it
+	roomDraining
+	// its loop has exited and it is gone from rooms
+	roomClosed
+)
+
+// enter queues c to join the room, reporting false when the room is closing
+func (r *room) enter(c *client) bool {
+	r.gate.RLock()
+	defer r.gate.RUnlock()
+	if r.closing {
+		return false
+	}
+	r.join <- c
+	return true
+}
+
+// exit queues c to leave the room, a no-op once the room's loop has exited
+func (r *room) exit(c *client) {
+	select {
+	case r.leave <- c:
+	case <-r.quit:
+	}
+}
+
+// closeRoom tears a room down: getRoom stops handing it out, new joins are
+// refused, every client is disconnected with reason, and the room's loop
+// exits. Envelopes still being sent to it are dropped.
+func closeRoom(r *room, reason string) {
+	mu.Lock()
+	if r.state != roomActive {
+		mu.Unlock()
+		return
+	}
+	r.state = roomDraining
+	mu.Unlock()
+
+	// waits for joins already being sent, run() handles or drains them
+	r.gate.Lock()
+	r.closing = true
+	r.gate.Unlock()
+
+	r.do(func() {
+		for c := range r.clients {
+			r.disconnect(c, reason, websocket.CloseGoingAway)
+		}
+		for _, sm := range r.scheduled {
+			sm.timer.Stop()
+		}
+		for _, p := range r.polls {
+			if p.timer != nil {
+				p.timer.Stop()
+			}
+		}
+		r.stopping = true
+		r.stopReason = reason
+	})
+
+	mu.Lock()
+	r.state = roomClosed
+	name := r.name
+	if rooms[name] == r {
+		delete(rooms, name)
+	}
+	mu.Unlock()
+	emit(roomEvent{kind: eventRoomClosed, room: name})
+}
+
+// stop ends run() after closeRoom, disconnecting clients whose joins were
+// still queued; called on the room's goroutine
+func (r *room) stop() {
+	for {
+		select {
+		case c := <-r.join:
+			c.left = true
+			c.close(websocket.CloseGoingAway, r.stopReason)
+		default:
+			r.stopFanout()
+			close(r.quit)
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// racing close calls must close receive exactly once and end write() with
+// the close frame of whichever came first
+func TestClientCloseConcurrent(t *testing.T) {
+	fake := newFakeTransport()
+	c := &client{
+		transport: fake,
+		room:      &room{name: "close"},
+		receive:   make(chan []byte, 1),
+		done:      make(chan struct{}),
+		name:      "alice",
+	}
+	go c.write()
+
+	codes := []int{websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.ClosePolicyViolation}
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			c.close(codes[i%len(codes)], "")
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	select {
+	case <-c.done:
+	case <-time.After(testTimeout):
+		t.Fatal("write() did not exit after close")
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.closeCode != c.closeCode || fake.closeCode == 0 {
+		t.Errorf("close frame %d, want the first close's code %d", fake.closeCode, c.closeCode)
+	}
+}
+
+// a client leaving on its own while it is disconnected and its room is closed is
+// torn down once, whichever path gets there first
+func TestTeardownPathsRace(t *testing.T) {
+	for range 20 {
+		r := newTestRoom(t, "teardown-race")
+		var clients []*testClient
+		for _, name := range []string{"alice", "bob", "carol"} {
+			clients = append(clients, joinTestRoom(t, r, name))
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range clients {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				c.leave()
+			}()
+			go func() {
+				defer wg.Done()
+				r.do(func() {
+					r.disconnect(c.client, "archived", websocket.CloseGoingAway)
+				})
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			closeRoom(r.room, "shutdown")
+		}()
+		wg.Wait()
+
+		for _, c := range clients {
+			select {
+			case <-c.done:
+			case <-time.After(testTimeout):
+				t.Fatalf("write() of %s did not exit", c.name)
+			}
+		}
+	}
+}
+
+// creating, joining and closing a room of the same name from many
+// goroutines never hands out a closed room for good, leaks a room loop or
+// strands a client
+func TestCreateDestroyHammer(t *testing.T) {
+	const name = "hammer"
+	var (
+		wg      sync.WaitGroup
+		seenMu  sync.Mutex
+		seen    = make(map[*room]bool)
+		clients []*client
+	)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				r := getRoom(name)
+				seenMu.Lock()
+				seen[r] = true
+				seenMu.Unlock()
+
+				switch (i + j) % 3 {
+				case 0:
+					closeRoom(r, "archived")
+				case 1:
+					c := &client{
+						transport: newFakeTransport(),
+						room:      r,
+						receive:   make(chan []byte, 16),
+						done:      make(chan struct{}),
+						name:      "hammer",
+					}
+					if !r.enter(c) {
+						continue
+					}
+					seenMu.Lock()
+					clients = append(clients, c)
+					seenMu.Unlock()
+					go c.write()
+					r.exit(c)
+				default:
+					r.do(func() {})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	current, ok := rooms[name]
+	if ok && current.state != roomActive {
+		t.Errorf("rooms holds a room in state %d", current.state)
+	}
+	mu.Unlock()
+	if ok {
+		closeRoom(current, "archived")
+	}
+
+	for r := range seen {
+		select {
+		case <-r.quit:
+		case <-time.After(testTimeout):
+			t.Fatal("a closed room's loop did not exit")
+		}
+	}
+	for _, c := range clients {
+		select {
+		case <-c.done:
+		case <-time.After(testTimeout):
+			t.Fatal("a client that joined was never let go")
+		}
+	}
+}
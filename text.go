@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// textRejection is why prepareText refused a text, as an error code and
+// system message
+type textRejection struct {
+	code string
+	key  string
+	args []any
+}
+
+// prepareText applies the rules every chat text goes through, from clients
+// and webhooks alike: shortcode expansion, the blank line limit and
+// MAX_MESSAGE_RUNES. It reports whether the text was truncated to fit, or
+// why it must be refused.
+func prepareText(text string) (string, bool, *textRejection) {
+	// a password is kept exactly as typed, see setPasswordCommand; its
+	// length is checked there and the frame is bounded by MAX_MESSAGE_BYTES
+	if isCommand(text, "/setpass") {
+		return text, false, nil
+	}
+
+	// code is kept as typed, a :name: in it is rarely meant as an emoji
+	if cfg.emojiShortcodes && !isCommand(text, "/code") {
+		text = expandShortcodes(text)
+	}
+
+	// multi-line spam is collapsed or rejected to keep the feed readable
+	if cfg.maxBlankLines >= 0 && text != "" {
+		normalized, collapsed := normalizeWhitespace(text, cfg.maxBlankLines)
+		if collapsed && cfg.whitespacePolicy == "reject" {
+			return "", false, &textRejection{errInvalidMessage, "too_many_blank_lines", []any{cfg.maxBlankLines}}
+		}
+		text = normalized
+	}
+
+	// the length limit counts characters, not bytes, so multibyte text isn't penalized
+	if cfg.maxMessageRunes > 0 && utf8.RuneCountInString(text) > cfg.maxMessageRunes {
+		if cfg.messageRunesPolicy == "reject" {
+			return "", false, &textRejection{errMessageTooLong, "message_too_long", []any{cfg.maxMessageRunes}}
+		}
+		return truncate(text, cfg.maxMessageRunes), true, nil
+	}
+	return text, false, nil
+}
+
+// isCommand reports whether text is the slash command name, like /code
+func isCommand(text, name string) bool {
+	rest, ok := strings.CutPrefix(text, name)
+	return ok && (rest == "" || strings.ContainsRune(" \n\t", rune(rest[0])))
+}
+
+// normalizeWhitespace trims trailing whitespace from every line, drops
+// leading and trailing blank lines and collapses runs of more than maxBlank
+// blank lines. It reports whether any run had to be collapsed.
+func normalizeWhitespace(text string, maxBlank int) (string, bool) {
+	lines := strings.Split(text, "\n")
+	out := lines[:0]
+	blank, collapsed := 0, false
+
+	for _, line := range lines {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if line == "" {
+			blank++
+			if blank > maxBlank {
+				collapsed = true
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		out = append(out, line)
+	}
+
+	for len(out) > 0 && out[0] == "" {
+		out = out[1:]
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	return strings.Join(out, "\n"), collapsed
+}
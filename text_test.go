@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+// MAX_MESSAGE_RUNES counts characters, so text made of multibyte runes gets
+// as much room as ASCII
+func TestPrepareTextCountsRunes(t *testing.T) {
+	withConfig(t, func(c *config) {
+		c.maxMessageRunes = 5
+		c.emojiShortcodes = false
+	})
+	tests := []struct {
+		name, text, policy string
+		want               string
+		truncated          bool
+		rejected           bool
+	}{
+		{name: "cjk at limit", text: "こんにちは", policy: "reject", want: "こんにちは"},
+		{name: "emoji at limit", text: "😀😃😄😁😆", policy: "reject", want: "😀😃😄😁😆"},
+		{name: "cjk over limit", text: "こんにちは世界", policy: "reject", rejected: true},
+		{name: "emoji over limit", text: "😀😃😄😁😆😅", policy: "reject", rejected: true},
+		{name: "cjk truncated", text: "こんにちは世界", policy: "truncate", want: "こんにちは", truncated: true},
+		{name: "emoji truncated", text: "😀😃😄😁😆😅", policy: "truncate", want: "😀😃😄😁😆", truncated: true},
+		{name: "mixed truncated", text: "ok👍日本語です", policy: "truncate", want: "ok👍日本", truncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.messageRunesPolicy = tt.policy
+			got, truncated, rejected := prepareText(tt.text)
+			if tt.rejected {
+				if rejected == nil || rejected.code != errMessageTooLong {
+					t.Fatalf("prepareText(%q) = %q, %v, want %s", tt.text, got, rejected, errMessageTooLong)
+				}
+				return
+			}
+			if rejected != nil || got != tt.want || truncated != tt.truncated {
+				t.Fatalf("prepareText(%q) = %q, %v, %v, want %q, %v", tt.text, got, truncated, rejected, tt.want, tt.truncated)
+			}
+			if !utf8.ValidString(got) {
+				t.Fatalf("prepareText(%q) cut a rune in half: %q", tt.text, got)
+			}
+		})
+	}
+}
+
+// over-length text from a client is refused with MESSAGE_TOO_LONG and
+// never reaches the room
+func TestLongMessageRejected(t *testing.T) {
+	withConfig(t, func(c *config) {
+		c.maxMessageRunes = 3
+		c.messageRunesPolicy = "reject"
+	})
+	r := newTestRoom(t, "runes")
+	alice := joinTestRoom(t, r, "alice")
+
+	alice.send("日本語です")
+	if e := alice.expect("error"); e.Code != errMessageTooLong {
+		t.Fatalf("got %+v, want %s", e, errMessageTooLong)
+	}
+	alice.send("日本語")
+	if e := alice.expect("message"); e.Message != "日本語" || e.Seq != 1 {
+		t.Fatalf("got %+v, want 日本語 as seq 1", e)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries a client's frames to and from the browser. The room
+// and client only deal in whole frames, so other wires (SSE, long polling)
+// can be added by implementing this next to the WebSocket one.
+type Transport interface {
+	// Read blocks until the client sends a frame. A client that closed the
+	// connection on purpose is reported as a *websocket.CloseError with the
+	// code it sent, see leaveReason.
+	Read() ([]byte, error)
+
+	// Write sends one frame, failing once the write deadline passes
+	Write(msg []byte) error
+
+	// Ping checks the client is still there, OnPong runs on each answer;
+	// wires without pings return nil and never call it
+	Ping() error
+	OnPong(f func())
+
+	// Read fails once the read deadline passes, writes once the write
+	// deadline does
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+
+	// WriteClose tells the client why it is being disconnected, before Close
+	WriteClose(code int, reason string) error
+	Close() error
+}
+
+// wsTransport is a Transport over a gorilla/websocket connection. Writes,
+// pings and the write deadline belong to the client's write() goroutine.
+type wsTransport struct {
+	socket *websocket.Conn
+
+	// gorilla takes a deadline per control frame rather than the
+	// connection's, so it is kept for pings and close frames
+	writeDeadline time.Time
+
+	// frames are binary for the protobuf subprotocol, text otherwise
+	messageType int
+}
+
+func newWSTransport(socket *websocket.Conn) *wsTransport {
+	t := &wsTransport{socket: socket, messageType: websocket.TextMessage}
+	if socket.Subprotocol() == protoSubprotocol {
+		t.messageType = websocket.BinaryMessage
+	}
+	return t
+}
+
+func (t *wsTransport) Read() ([]byte, error) {
+	_, msg, err := t.socket.ReadMessage()
+	return msg, err
+}
+
+func (t *wsTransport) Write(msg []byte) error {
+	return t.socket.WriteMessage(t.messageType, msg)
+}
+
+func (t *wsTransport) Ping() error {
+	return t.socket.WriteControl(websocket.PingMessage, nil, t.writeDeadline)
+}
+
+func (t *wsTransport) OnPong(f func()) {
+	t.socket.SetPongHandler(func(string) error {
+		f()
+		return nil
+	})
+}
+
+func (t *wsTransport) SetReadDeadline(deadline time.Time) error {
+	return t.socket.SetReadDeadline(deadline)
+}
+
+func (t *wsTransport) SetWriteDeadline(deadline time.Time) error {
+	t.writeDeadline = deadline
+	return t.socket.SetWriteDeadline(deadline)
+}
+
+func (t *wsTransport) WriteClose(code int, reason string) error {
+	frame := websocket.FormatCloseMessage(code, reason)
+	return t.socket.WriteControl(websocket.CloseMessage, frame, t.writeDeadline)
+}
+
+func (t *wsTransport) Close() error {
+	return t.socket.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// who may send a client type in a room, see /types
+const (
+	typeAllowAll        = "all"
+	typeAllowModerators = "moderators"
+	typeAllowNone       = "none"
+)
+
+// clientTypeNames are the clientTypes in the order they are listed
+var clientTypeNames = []string{"message", "vote", "seen", "edit", "schedule", "unschedule"}
+
+// typeAllowed reports whether the room accepts e from its sender. Only
+// frames clients may send are restricted, and commands are left to
+// /commands even though they arrive as messages.
+func (r *room) typeAllowed(e *envelope) bool {
+	if !clientTypes[e.Type] || e.Type == "message" && strings.HasPrefix(e.Message, "/") {
+		return true
+	}
+	switch r.typePolicy(e.Type) {
+	case typeAllowModerators:
+		return e.from.moderator
+	case typeAllowNone:
+		return false
+	}
+	return true
+}
+
+// typePolicy says who may send a client type, called from run()
+func (r *room) typePolicy(typ string) string {
+	if policy, ok := r.types[typ]; ok {
+		return policy
+	}
+	return typeAllowAll
+}
+
+// typePolicies lists who may send each client type given a room's
+// restrictions, nil for a room without any
+func typePolicies(types map[string]string) map[string]string {
+	policies := make(map[string]string, len(clientTypeNames))
+	for _, typ := range clientTypeNames {
+		policies[typ] = typeAllowAll
+		if policy, ok := types[typ]; ok {
+			policies[typ] = policy
+		}
+	}
+	return policies
+}
+
+// rejectType tells a client the room doesn't accept what it sent
+func (r *room) rejectType(c *client, typ string) {
+	if r.typePolicy(typ) == typeAllowModerators {
+		r.reject(c, errTypeNotAllowed, "type_moderators_only", typ)
+		return
+	}
+	r.reject(c, errTypeNotAllowed, "type_not_allowed", typ)
+}
+
+// typesCommand handles /types, listing who may send what, and for
+// moderators /types all or /types <type>=<all|moderators|none>... to change it
+func (r *room) typesCommand(c *client, args []string) {
+	if len(args) == 0 {
+		r.notify(c, "types_set", r.describeTypes())
+		return
+	}
+	if !c.moderator {
+		r.reject(c, errForbidden, "moderators_only")
+		return
+	}
+
+	if len(args) == 1 && args[0] == typeAllowAll {
+		r.types = nil
+	} else {
+		changes := make(map[string]string, len(args))
+		for _, arg := range args {
+			typ, policy, ok := strings.Cut(arg, "=")
+			if !ok || !slices.Contains(clientTypeNames, typ) ||
+				policy != typeAllowAll && policy != typeAllowModerators && policy != typeAllowNone {
+				r.reject(c, errInvalidCommand, "types_usage", strings.Join(clientTypeNames, ", "))
+				return
+			}
+			changes[typ] = policy
+		}
+		for typ, policy := range changes {
+			r.setTypePolicy(typ, policy)
+		}
+	}
+	r.saveRoomConfig()
+	r.notify(c, "types_set", r.describeTypes())
+}
+
+// setTypePolicy changes who may send a client type, only restrictions are kept
+func (r *room) setTypePolicy(typ, policy string) {
+	if policy == typeAllowAll {
+		delete(r.types, typ)
+		return
+	}
+	if r.types == nil {
+		r.types = make(map[string]string)
+	}
+	r.types[typ] = policy
+}
+
+// describeTypes lists the room's type policy for /types
+func (r *room) describeTypes() string {
+	parts := make([]string, 0, len(clientTypeNames))
+	for _, typ := range clientTypeNames {
+		parts = append(parts, fmt.Sprintf("%s=%s", typ, r.typePolicy(typ)))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// only this much of a linked page is read when looking for metadata
+	maxUnfurlBodySize = 512 << 10
+
+	// upper bound on cached previews before the cache is reset
+	maxPreviewCacheSize = 1024
+
+	maxPreviewTitleLen       = 200
+	maxPreviewDescriptionLen = 300
+)
+
+var (
+	linkPattern  = regexp.MustCompile(`https?://[^\s<>"']+`)
+	metaPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrPattern  = regexp.MustCompile(`(?is)(property|name|content)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	titlePattern = regexp.MustCompile(`(?is)<title[^>]*>([^<]*)</title>`)
+
+	errBlockedAddress = errors.New("refusing to fetch non-public address")
+)
+
+// linkPreview holds the OpenGraph metadata of a page
+type linkPreview struct {
+	title       string
+	description string
+	image       string
+}
+
+// previews are cached by URL, including empty ones so failing links aren't refetched
+var previewCache = struct {
+	sync.Mutex
+	entries map[string]*linkPreview
+}{entries: make(map[string]*linkPreview)}
+
+// unfurlClient only dials public addresses so chat links can't be used to probe the internal network
+var unfurlClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+					return errBlockedAddress
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// findLink returns the first http(s) URL in text, or ""
+func findLink(text string) string {
+	return strings.TrimRight(linkPattern.FindString(text), ".,;:!?)")
+}
+
+// unfurl fetches the preview for link and broadcasts it as a follow-up to message seq.
+// It runs in its own goroutine so broadcasting the original message is never delayed.
+func (r *room) unfurl(seq uint64, link string) {
+	p := cachedPreview(link)
+	if p == nil {
+		var err error
+		p, err = fetchPreview(link)
+		if err != nil {
+			log.Println("Unfurl failed:", link, err)
+			p = &linkPreview{}
+		}
+		cachePreview(link, p)
+	}
+
+	if p.title == "" && p.description == "" && p.image == "" {
+		return
+	}
+	r.submit(&envelope{
+		Type:        "preview",
+		Seq:         seq,
+		URL:         link,
+		Title:       p.title,
+		Description: p.description,
+		Image:       p.image,
+	})
+}
+
+func cachedPreview(link string) *linkPreview {
+	previewCache.Lock()
+	defer previewCache.Unlock()
+	return previewCache.entries[link]
+}
+
+func cachePreview(link string, p *linkPreview) {
+	previewCache.Lock()
+	defer previewCache.Unlock()
+	if len(previewCache.entries) >= maxPreviewCacheSize {
+		previewCache.entries = make(map[string]*linkPreview)
+	}
+	previewCache.entries[link] = p
+}
+
+// fetchPreview downloads the start of an HTML page and extracts its OpenGraph metadata
+func fetchPreview(link string) (*linkPreview, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.unfurlTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := unfurlClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return &linkPreview{}, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxUnfurlBodySize))
+	if err != nil {
+		return nil, err
+	}
+	return parsePreview(string(body)), nil
+}
+
+// parsePreview extracts og:title, og:description and og:image, falling back
+// to the <title> tag and the plain description meta tag
+func parsePreview(page string) *linkPreview {
+	p := &linkPreview{}
+	var fallbackDescription string
+
+	for _, tag := range metaPattern.FindAllString(page, -1) {
+		var key, content string
+		for _, attr := range attrPattern.FindAllStringSubmatch(tag, -1) {
+			value := attr[2] + attr[3]
+			if strings.EqualFold(attr[1], "content") {
+				content = value
+			} else {
+				key = strings.ToLower(value)
+			}
+		}
+		content = html.UnescapeString(strings.TrimSpace(content))
+
+		switch key {
+		case "og:title":
+			p.title = content
+		case "og:description":
+			p.description = content
+		case "og:image":
+			p.image = content
+		case "description":
+			fallbackDescription = content
+		}
+	}
+
+	if p.title == "" {
+		if m := titlePattern.FindStringSubmatch(page); m != nil {
+			p.title = html.UnescapeString(strings.TrimSpace(m[1]))
+		}
+	}
+	if p.description == "" {
+		p.description = fallbackDescription
+	}
+	if !strings.HasPrefix(p.image, "https://") && !strings.HasPrefix(p.image, "http://") {
+		p.image = ""
+	}
+
+	p.title = truncate(p.title, maxPreviewTitleLen)
+	p.description = truncate(p.description, maxPreviewDescriptionLen)
+	return p
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
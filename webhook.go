@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// maximum accepted size of an incoming webhook request body
+const maxHookBodySize = 64 << 10
+
+// slackPayload is the subset of Slack's incoming webhook format we understand
+type slackPayload struct {
+	Text     string `json:"text"`
+	Username string `json:"username"`
+}
+
+// hookToken is the secret webhooks into rooms matching pattern must carry
+type hookToken struct {
+	pattern string
+	token   string
+}
+
+// parseHookTokens parses HOOK_TOKENS, comma separated entries of a room
+// pattern, '=' and the token: "alerts=s3cret,ci-*=0ther-s3cret"
+func parseHookTokens(s string) ([]hookToken, error) {
+	var list []hookToken
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, token, ok := strings.Cut(entry, "=")
+		pattern, token = strings.TrimSpace(pattern), strings.TrimSpace(token)
+		if _, err := path.Match(pattern, ""); !ok || pattern == "" || token == "" || err != nil {
+			return nil, fmt.Errorf("invalid entry for %q", pattern)
+		}
+		list = append(list, hookToken{pattern: pattern, token: token})
+	}
+	return list, nil
+}
+
+// hookTokenFor returns the token of the first HOOK_TOKENS entry matching
+// room, "" when the room takes no webhooks
+func hookTokenFor(room string) string {
+	for _, ht := range cfg.hookTokens {
+		if ok, _ := path.Match(ht.pattern, room); ok {
+			return ht.token
+		}
+	}
+	return ""
+}
+
+// hookHandler accepts Slack-compatible incoming webhooks on POST /hooks/{room}
+// and injects the message into the room, so existing integrations can post here.
+// The room's HOOK_TOKENS token comes as a bearer token, or for tools that
+// only take a URL as POST /hooks/{room}/{token} like Slack's.
+func hookHandler(w http.ResponseWriter, r *http.Request) {
+	roomName := r.PathValue("room")
+	want := hookTokenFor(roomName)
+	if !validRoomName(roomName) || want == "" {
+		http.Error(w, "channel_not_found", http.StatusNotFound)
+		return
+	}
+	token := r.PathValue("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBodySize))
+	if err != nil {
+		http.Error(w, "invalid_payload", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// slack accepts a raw JSON body or a form-encoded payload= field
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil || form.Get("payload") == "" {
+			http.Error(w, "invalid_payload", http.StatusBadRequest)
+			return
+		}
+		body = []byte(form.Get("payload"))
+	default:
+		http.Error(w, "invalid_content_type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var payload slackPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+		return
+	}
+
+	// the same rules as text from clients, "system" and other names
+	// clients can't pick are refused
+	if payload.Username == "" {
+		payload.Username = "webhook"
+	}
+	if !validName(payload.Username) {
+		http.Error(w, "invalid_username", http.StatusBadRequest)
+		return
+	}
+	text, _, rejected := prepareText(payload.Text)
+	if rejected != nil {
+		http.Error(w, strings.ToLower(rejected.code), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(text) == "" {
+		http.Error(w, "no_text", http.StatusBadRequest)
+		return
+	}
+
+	if !checkRoomPassword(roomName, r) {
+		http.Error(w, "invalid_password", http.StatusUnauthorized)
+		return
+	}
+	if !allowRoomCreation(w, r, roomName) {
+		return
+	}
+	room := getRoom(roomName)
+	// post() would drop the message quietly, webhooks aren't moderators
+	var paused bool
+	room.do(func() {
+		paused = room.paused
+	})
+	if paused {
+		http.Error(w, strings.ToLower(errRoomPaused), http.StatusForbidden)
+		return
+	}
+	room.submit(newMessage(payload.Username, text))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}